@@ -0,0 +1,145 @@
+package main
+
+import "sync"
+
+// The goroutine owning an active game. Every read and change of the game
+// is a command run by this goroutine, one after another, so that the
+// game needs no further locking. See Game.Do.
+type gameOwner struct {
+	// Commands to run. Nil while the game has no owner.
+	commands chan func()
+
+	// Held while commands are sent, locked to start or stop the owner.
+	lock sync.RWMutex
+
+	// Set by the last command of a retired game, only used by the
+	// owning goroutine. Commands after it fail.
+	retiring bool
+
+	// Set once the game is retired, commands fail from then on. See
+	// retire.
+	retired bool
+
+	// Held while the rematch of the game is created
+	rematchLock sync.Mutex
+}
+
+// Run the command on the goroutine owning the game and wait for it. A
+// panic of the command is passed on to the caller.
+//
+// Games that are not active, e.g. while they are set up or loaded, have
+// no owner and the command is run right away: they must only be used by
+// one goroutine. Commands must not call Do of the same game, which is
+// why the exported methods of Game, which use Do, are only thin wrappers
+// around unexported methods that do the work.
+func (g *Game) Do(command func()) {
+	if g.owner == nil {
+		command()
+		return
+	}
+
+	g.owner.lock.RLock()
+
+	if g.owner.commands == nil {
+		retired := g.owner.retired
+		g.owner.lock.RUnlock()
+
+		if retired {
+			panic(ErrGameUnloaded(g.hash))
+		}
+
+		command()
+		return
+	}
+
+	done := make(chan interface{}, 1)
+
+	g.owner.commands <- func() {
+		defer func() { done <- recover() }()
+
+		if g.owner.retiring {
+			panic(ErrGameUnloaded(g.hash))
+		}
+
+		command()
+	}
+
+	g.owner.lock.RUnlock()
+
+	if failure := <-done; failure != nil {
+		panic(failure)
+	}
+}
+
+// Start the goroutine owning the game, if it is not running yet.
+func (g *Game) own() {
+	g.owner.lock.Lock()
+	defer g.owner.lock.Unlock()
+
+	if g.owner.commands != nil {
+		return
+	}
+
+	g.owner.commands = make(chan func())
+
+	go func(commands chan func()) {
+		for command := range commands {
+			command()
+		}
+	}(g.owner.commands)
+}
+
+// Stop the goroutine owning the game after the pending commands.
+func (g *Game) release() {
+	g.owner.lock.Lock()
+	defer g.owner.lock.Unlock()
+
+	if g.owner.commands != nil {
+		close(g.owner.commands)
+		g.owner.commands = nil
+	}
+}
+
+// Stop the goroutine owning the game for good if canRetire, which is
+// run as a command, agrees. Commands sent afterwards fail instead of
+// changing the game, so that nobody holding on to the game changes it
+// once it may have been loaded again.
+func (g *Game) retire(canRetire func() bool) (retired bool) {
+	g.Do(func() {
+		retired = canRetire()
+		g.owner.retiring = retired
+	})
+
+	if !retired {
+		return false
+	}
+
+	g.owner.lock.Lock()
+	defer g.owner.lock.Unlock()
+
+	g.owner.retired = true
+
+	if g.owner.commands != nil {
+		close(g.owner.commands)
+		g.owner.commands = nil
+	}
+
+	return true
+}
+
+// A copy of the game as it is now, e.g. for rendering. The copy has no
+// owner and is not saved.
+func (g *Game) Snapshot() *Game {
+	var snapshot Game
+
+	g.Do(func() {
+		snapshot = *g
+		snapshot.Players = append([]Player(nil), g.Players...)
+	})
+
+	snapshot.owner = nil
+	snapshot.saveHandler = nil
+	snapshot.journalHandler = nil
+
+	return &snapshot
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/githubnemo/wikirace-serv/wikis"
+)
+
+// Run with -race, the test is about data races as much as about the
+// outcome.
+func TestConcurrentCommandsOfOwnedGame(t *testing.T) {
+	game := simpleTwoPlayerGame()
+	game.hash = "game"
+	game.own()
+	defer game.release()
+
+	const players, visits = 20, 50
+
+	var wg, joined sync.WaitGroup
+
+	// Nobody joins once there is a winner, so the race only starts
+	// after everybody joined.
+	start := make(chan struct{})
+
+	for i := 0; i < players; i++ {
+		wg.Add(1)
+		joined.Add(1)
+
+		go func(name string) {
+			defer wg.Done()
+
+			err := game.Join(name, "", JoinCredentials{})
+
+			joined.Done()
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			<-start
+
+			player := game.PlayerCopy(name)
+
+			for j := 0; j < visits; j++ {
+				game.Visit(player, fmt.Sprintf("page %d", j))
+
+				game.Standings()
+				game.SortedPlayers()
+				game.TeamStandings()
+				game.State()
+				game.Snapshot()
+				game.CanJoin(name, JoinCredentials{})
+			}
+
+			game.Visit(player, game.Goal)
+
+			if game.HasFinished(game.PlayerCopy(name)) {
+				game.EvaluateWinner(player)
+			}
+		}(fmt.Sprintf("racer %d", i))
+	}
+
+	joined.Wait()
+	close(start)
+
+	wg.Wait()
+
+	for i := 0; i < players; i++ {
+		name := fmt.Sprintf("racer %d", i)
+		player := game.PlayerCopy(name)
+
+		if player == nil {
+			t.Fatalf("Player %s is missing.", name)
+		}
+
+		if len(player.Path) != visits+1 {
+			t.Errorf("Player %s visited %d pages, expected %d.", name, len(player.Path), visits+1)
+		}
+	}
+
+	if winner := game.GetWinner(); winner == nil {
+		t.Error("Expected a winner.")
+	}
+}
+
+// Visiting the goal, judging the winner and the standings are one
+// command, so every player racing to the goal sees the standings
+// right after his own visit and no two see the same ones.
+func TestConcurrentVisitsOfTheGoal(t *testing.T) {
+	game := simpleTwoPlayerGame()
+	game.hash = "game"
+	game.own()
+	defer game.release()
+
+	const players = 20
+
+	for i := 0; i < players; i++ {
+		if err := game.Join(fmt.Sprintf("racer %d", i), "", JoinCredentials{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	seen := map[int]bool{}
+
+	for i := 0; i < players; i++ {
+		wg.Add(1)
+
+		go func(name string) {
+			defer wg.Done()
+
+			result, err := game.VisitPage(name, "goal page")
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if s := result.Standings.Get(name); !result.Finished || s == nil || s.Status != StatusFinished {
+				t.Errorf("Expected %s to have finished.", name)
+			}
+
+			finished := 0
+
+			for _, s := range result.Standings {
+				if s.Status == StatusFinished {
+					finished++
+				}
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			if seen[finished] {
+				t.Errorf("Two visits saw %d finished players.", finished)
+			}
+
+			seen[finished] = true
+		}(fmt.Sprintf("racer %d", i))
+	}
+
+	wg.Wait()
+
+	if winner := game.GetWinner(); winner == nil {
+		t.Error("Expected a winner.")
+	}
+
+	if _, err := game.VisitPage("nobody", "goal page"); err == nil {
+		t.Error("Expected unknown players to be refused.")
+	}
+
+	game.End()
+
+	if _, err := game.VisitPage("racer 0", "start page"); err == nil {
+		t.Error("Expected visits of an ended game to be refused.")
+	}
+}
+
+func TestConcurrentJoinsWithTheSameName(t *testing.T) {
+	game := simpleTwoPlayerGame()
+	game.hash = "game"
+	game.own()
+	defer game.release()
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	joined := 0
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if err := game.Join("player 3", "", JoinCredentials{}); err == nil {
+				lock.Lock()
+				joined++
+				lock.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if joined != 1 || len(game.SortedPlayers()) != 3 {
+		t.Errorf("Expected exactly one join, got %d and %d players.", joined, len(game.SortedPlayers()))
+	}
+}
+
+func TestDoPassesPanicsOn(t *testing.T) {
+	game := simpleTwoPlayerGame()
+	game.own()
+	defer game.release()
+
+	failure := errors.New("failure")
+
+	defer func() {
+		if recover() != failure {
+			t.Error("Expected the panic of the command.")
+		}
+
+		// The owner survives the panic.
+		if !game.HasPlayer("player 1") {
+			t.Error("Game does not answer after panic.")
+		}
+	}()
+
+	game.Do(func() {
+		panic(failure)
+	})
+}
+
+// Players racing in a stored game with the changes written in the
+// background, as the server does it.
+func TestConcurrentVisitsOfStoredGame(t *testing.T) {
+	repository := NewMemoryStore()
+	store := NewGameStore(repository, NewMemoryStore())
+	persister := store.WriteBehind(time.Millisecond)
+
+	go persister.Run()
+
+	game := NewGame("player 1", nil, nil)
+	game.hash = "game"
+	game.Start = "start page"
+	game.Goal = "goal page"
+	game.saveHandler = store.gameSaveHandler
+	game.journalHandler = store.journalHandler
+
+	if err := store.PutGame(game); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("racer %d", i)
+
+		if err := game.Join(name, "", JoinCredentials{}); err != nil {
+			t.Fatal(err)
+		}
+
+		wg.Add(1)
+
+		go func(player *Player) {
+			defer wg.Done()
+
+			for j := 0; j < 20; j++ {
+				game.Visit(player, fmt.Sprintf("page %d", j))
+				game.PassCheckpoint(player, fmt.Sprintf("page %d", j))
+			}
+		}(game.PlayerCopy(name))
+	}
+
+	wg.Wait()
+	persister.Stop()
+
+	loaded, err := NewGameStore(repository, NewMemoryStore()).GetGameByHash("game")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("racer %d", i)
+
+		if p := loaded.PlayerCopy(name); p == nil || len(p.Path) != 20 {
+			t.Errorf("Player %s was not stored with all visits: %#v", name, p)
+		}
+	}
+}
+
+// Players asking for a rematch at the same time all end up in the same
+// rematch, and only one of them created it.
+func TestConcurrentRematches(t *testing.T) {
+	defer func(old *GameStore) { gameStore = old }(gameStore)
+
+	gameStore = NewGameStore(NewMemoryStore(), NewMemoryStore())
+
+	var pages int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<h1 id="firstHeading">Page %d</h1>`, atomic.AddInt32(&pages, 1))
+	}))
+	defer server.Close()
+
+	game := gameStore.NewGame("player 1", &wikis.Wiki{URL: server.URL, RandomPage: "Random"})
+
+	if err := gameStore.PutGame(game); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var created int
+
+	rematches := make(map[string]bool)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func(name string) {
+			defer wg.Done()
+
+			rematch, isNew, err := gameStore.NewRematch(game, name, []string{name})
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			rematches[rematch.Hash()] = true
+
+			if isNew {
+				created++
+			}
+		}(fmt.Sprintf("player %d", i))
+	}
+
+	wg.Wait()
+
+	if len(rematches) != 1 || created != 1 {
+		t.Errorf("Expected one created rematch, got %d rematches and %d created.", len(rematches), created)
+	}
+}
+
+// Repository that holds up reading the game "slow" until released, if
+// there is a release.
+type slowRepository struct {
+	*Store
+
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (r *slowRepository) GetMarshal(key string, v interface{}) error {
+	if key == "slow" && r.release != nil {
+		r.reading <- struct{}{}
+		<-r.release
+	}
+
+	return r.Store.GetMarshal(key, v)
+}
+
+// A game that is slow to load holds up neither other games nor the
+// store, and is still loaded only once.
+func TestConcurrentLoadsOfStoredGame(t *testing.T) {
+	repository := &slowRepository{NewMemoryStore(), make(chan struct{}, 10), make(chan struct{})}
+
+	for _, hash := range []string{"slow", "fast"} {
+		game := NewGame("player 1", nil, nil)
+		game.hash = hash
+
+		if err := repository.PutMarshal(hash, game); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := NewGameStore(repository, NewMemoryStore())
+
+	const loads = 5
+
+	games := make(chan *Game, loads)
+
+	for i := 0; i < loads; i++ {
+		go func() {
+			game, err := store.GetGameByHash("slow")
+
+			if err != nil {
+				t.Error(err)
+			}
+
+			games <- game
+		}()
+	}
+
+	<-repository.reading
+
+	if _, err := store.GetGameByHash("fast"); err != nil {
+		t.Fatal(err)
+	}
+
+	close(repository.release)
+
+	first := <-games
+
+	for i := 1; i < loads; i++ {
+		if game := <-games; game != first {
+			t.Error("Expected the same instance of the game.")
+		}
+	}
+
+	if len(repository.reading) != 0 {
+		t.Error("Expected the game to be read once.")
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+)
+
+// Ways to sort game summaries, prefixed with "-" for descending order.
+var summaryOrders = map[string]func(a, b *GameSummary) bool{
+	"created": func(a, b *GameSummary) bool { return a.CreatedAt.Before(b.CreatedAt) },
+	"host":    func(a, b *GameSummary) bool { return a.Host < b.Host },
+	"wiki":    func(a, b *GameSummary) bool { return a.Wiki < b.Wiki },
+	"players": func(a, b *GameSummary) bool { return len(a.Players) < len(b.Players) },
+}
+
+type sortableSummaries struct {
+	games []GameSummary
+	less  func(a, b *GameSummary) bool
+}
+
+func (s sortableSummaries) Len() int           { return len(s.games) }
+func (s sortableSummaries) Swap(i, j int)      { s.games[i], s.games[j] = s.games[j], s.games[i] }
+func (s sortableSummaries) Less(i, j int) bool { return s.less(&s.games[i], &s.games[j]) }
+
+// Sort the summaries in the given order, e.g. "-created" for the newest
+// games first. Ties keep the order of the hashes.
+func SortGameSummaries(games []GameSummary, order string) error {
+	descending := strings.HasPrefix(order, "-")
+
+	less, ok := summaryOrders[strings.TrimPrefix(order, "-")]
+
+	if !ok {
+		return fmt.Errorf("Unknown order %q.", order)
+	}
+
+	if descending {
+		ascending := less
+		less = func(a, b *GameSummary) bool { return ascending(b, a) }
+	}
+
+	sort.Stable(sortableSummaries{games, less})
+
+	return nil
+}
+
+// Page of the result of /api/games.
+type GamesResponse struct {
+	// Number of games matching the query
+	Total int
+
+	Offset int
+	Limit  int
+	Games  []GameSummary
+}
+
+// The query, order and page described by the URL parameters player,
+// host, wiki, state, winner, hasWinner, since and until (YYYY-MM-DD),
+// sort, offset and limit.
+func parseGamesRequest(values url.Values) (q GameQuery, order string, offset, limit int, err error) {
+	q = GameQuery{
+		Player:    values.Get("player"),
+		Host:      values.Get("host"),
+		Wiki:      values.Get("wiki"),
+		State:     GameState(values.Get("state")),
+		Winner:    values.Get("winner"),
+		HasWinner: values.Get("hasWinner") == "true",
+	}
+
+	if len(q.State) > 0 && q.State != GameRunning && q.State != GameOver {
+		err = fmt.Errorf("Unknown state %q.", q.State)
+		return
+	}
+
+	if err = q.SetDays(values.Get("since"), values.Get("until")); err != nil {
+		return
+	}
+
+	order = values.Get("sort")
+
+	if len(order) == 0 {
+		order = "-created"
+	}
+
+	limit = DefaultPageSize
+
+	if s := values.Get("limit"); len(s) > 0 {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > MaxPageSize {
+			err = fmt.Errorf("The limit has to be between 1 and %d.", MaxPageSize)
+			return
+		}
+	}
+
+	if s := values.Get("offset"); len(s) > 0 {
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			err = fmt.Errorf("The offset can't be negative.")
+			return
+		}
+	}
+
+	return
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		panic(err)
+	}
+}
+
+// Leave out private games, their hash is all it takes to find them.
+func publicGames(games []GameSummary) []GameSummary {
+	var public []GameSummary
+
+	for _, game := range games {
+		if !game.Private {
+			public = append(public, game)
+		}
+	}
+
+	return public
+}
+
+// Query the stored and the archived games, answered from the indexes of
+// the stores. Private games are never listed.
+func apiGamesHandler(w http.ResponseWriter, r *http.Request) {
+	q, order, offset, limit, err := parseGamesRequest(r.URL.Query())
+
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, struct{ Error string }{err.Error()})
+		return
+	}
+
+	games, err := gameStore.SummarizeAllGames(q)
+
+	if err != nil {
+		panic(err)
+	}
+
+	games = publicGames(games)
+
+	if err := SortGameSummaries(games, order); err != nil {
+		writeJSON(w, http.StatusBadRequest, struct{ Error string }{err.Error()})
+		return
+	}
+
+	response := GamesResponse{Total: len(games), Offset: offset, Limit: limit, Games: []GameSummary{}}
+
+	if offset < len(games) {
+		games = games[offset:]
+
+		if len(games) > limit {
+			games = games[:limit]
+		}
+
+		response.Games = games
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
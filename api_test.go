@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/githubnemo/wikirace-serv/wikis"
+)
+
+func TestAPIGames(t *testing.T) {
+	store := NewMemoryStore()
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.Local)
+
+	for i := 0; i < 10; i++ {
+		game := simpleTwoPlayerGame()
+		game.hash = fmt.Sprintf("game%d", i)
+		game.Wiki = &wikis.Wiki{URL: fmt.Sprintf("http://wiki%d", i%2)}
+		game.CreatedAt = base.AddDate(0, 0, i)
+
+		if i%3 == 0 {
+			game.setWinner(game.GetPlayer("player 2"))
+		}
+
+		store.PutMarshal(game.Hash(), game)
+	}
+
+	indexed, err := NewIndexedRepository(store)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(old *GameStore) { gameStore = old }(gameStore)
+	gameStore = NewGameStore(indexed, NewMemoryStore())
+
+	requests := map[string][]string{
+		"":                                       {"game9", "game8", "game7", "game6", "game5", "game4", "game3", "game2", "game1", "game0"},
+		"?hasWinner=true&wiki=http://wiki0":      {"game6", "game0"},
+		"?winner=player+2&sort=created":          {"game0", "game3", "game6", "game9"},
+		"?since=2024-05-03&until=2024-05-04":     {"game3", "game2"},
+		"?sort=created&offset=2&limit=3":         {"game2", "game3", "game4"},
+		"?sort=created&offset=20":                {},
+		"?player=player+1&state=running&limit=1": {"game9"},
+	}
+
+	for query, expected := range requests {
+		w := httptest.NewRecorder()
+		apiGamesHandler(w, httptest.NewRequest("GET", "/api/games"+query, nil))
+
+		var response GamesResponse
+
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil || w.Code != http.StatusOK {
+			t.Errorf("%s: status %d, %v", query, w.Code, err)
+			continue
+		}
+
+		var hashes []string
+
+		for _, game := range response.Games {
+			hashes = append(hashes, game.Hash)
+		}
+
+		if fmt.Sprint(hashes) != fmt.Sprint(expected) {
+			t.Errorf("%s: expected %v, got %v", query, expected, hashes)
+		}
+	}
+
+	for _, query := range []string{"?state=lost", "?limit=0", "?offset=-1", "?sort=name", "?since=yesterday"} {
+		w := httptest.NewRecorder()
+		apiGamesHandler(w, httptest.NewRequest("GET", "/api/games"+query, nil))
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected bad request, got %d", query, w.Code)
+		}
+	}
+}
+
+// Archived games are listed as well, and games are over once their
+// players ran out of time, although nothing was written since.
+func TestAPIGamesArchivedAndTimedOut(t *testing.T) {
+	store, archive := NewMemoryStore(), NewMemoryStore()
+
+	timed, archived := simpleTwoPlayerGame(), simpleTwoPlayerGame()
+	timed.hash, archived.hash = "timed", "archived"
+
+	timed.TimeLimit = time.Minute
+
+	for i := range timed.Players {
+		timed.Players[i].JoinedAt = time.Now().Add(-time.Minute + 50*time.Millisecond)
+	}
+
+	indexed, err := NewIndexedRepository(store)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	indexedArchive, err := NewIndexedRepository(archive)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	indexed.PutMarshal(timed.Hash(), timed)
+	indexedArchive.PutMarshal(archived.Hash(), ArchivedGame{time.Now(), archived})
+
+	defer func(old *GameStore) { gameStore = old }(gameStore)
+	gameStore = NewGameStore(indexed, indexedArchive)
+
+	query := func(query string) (games []GameSummary) {
+		w := httptest.NewRecorder()
+		apiGamesHandler(w, httptest.NewRequest("GET", "/api/games"+query, nil))
+
+		var response GamesResponse
+
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+
+		return response.Games
+	}
+
+	if games := query("?sort=host"); len(games) != 2 || games[0].Hash != "archived" || !games[0].Archived || games[1].Archived {
+		t.Errorf("Expected the archived game next to the stored one, got %+v", games)
+	}
+
+	if games := query("?state=running"); len(games) != 2 {
+		t.Errorf("Expected both games to be running, got %+v", games)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if games := query("?state=over"); len(games) != 1 || games[0].Hash != "timed" || games[0].State != GameOver {
+		t.Errorf("Expected the game to be over once the time ran out, got %+v", games)
+	}
+
+	if games := query("?state=running"); len(games) != 1 || games[0].Hash != "archived" {
+		t.Errorf("Expected only the archived game to be running, got %+v", games)
+	}
+}
+
+func TestAPIGamesLeavesOutPrivateGames(t *testing.T) {
+	store := NewMemoryStore()
+
+	public, private := simpleTwoPlayerGame(), simpleTwoPlayerGame()
+	public.hash, private.hash = "public", "private"
+	private.MakePrivate("secret")
+
+	store.PutMarshal(public.Hash(), public)
+	store.PutMarshal(private.Hash(), private)
+
+	indexed, err := NewIndexedRepository(store)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(old *GameStore) { gameStore = old }(gameStore)
+	gameStore = NewGameStore(indexed, NewMemoryStore())
+
+	for _, query := range []string{"", "?player=player+1", "?host=player+1", "?state=running"} {
+		w := httptest.NewRecorder()
+		apiGamesHandler(w, httptest.NewRequest("GET", "/api/games"+query, nil))
+
+		if strings.Contains(w.Body.String(), "private") {
+			t.Errorf("%s: private game is listed: %s", query, w.Body.String())
+		}
+
+		var response GamesResponse
+
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+
+		if response.Total != 1 || len(response.Games) != 1 || response.Games[0].Hash != "public" {
+			t.Errorf("%s: expected only the public game, got %+v", query, response)
+		}
+	}
+}
+
+func TestSuggestUnknownWiki(t *testing.T) {
+	defer func() {
+		if _, ok := recover().(UserFriendlyError); !ok {
+			t.Error("Expected a user friendly error for an unknown wiki.")
+		}
+	}()
+
+	suggestHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/suggest?wiki=http://nowhere&q=Phil", nil))
+}
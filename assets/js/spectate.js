@@ -0,0 +1,130 @@
+$(document).ready(function() {
+	function formatTitle(title) {
+		return title.replace(/_/g, " ");
+	}
+
+	function logMessage(message) {
+		$('#log').append($('<li>').text(message));
+	}
+
+	function findRacer(name) {
+		return $("#racers .racer").filter(function() {
+			return $(this).data("player") == name;
+		});
+	}
+
+	function newRacer(name) {
+		var $racer = $('<div class="racer span4"><h4><span class="name"></span> <span class="badge visits">0</span></h4>' +
+			'<p>Status: <span class="status">racing</span><br />Current page: <span class="current"></span></p>' +
+			'<ol class="path"></ol></div>');
+
+		$racer.attr("data-player", name);
+		$racer.find(".name").text(name);
+
+		return $racer;
+	}
+
+	// Show the full path of the player as sent with visit and join messages.
+	function updatePath(player) {
+		var $racer = findRacer(player["Name"]);
+		var path = player["Path"] || [];
+
+		if ($racer.length == 0) {
+			$racer = newRacer(player["Name"]);
+			$("#racers").append($racer);
+		}
+
+		$racer.find(".visits").text(path.length);
+		$racer.find(".path").empty();
+
+		$.each(path, function(i, page) {
+			$racer.find(".path").append($("<li>").text(formatTitle(page)));
+		});
+
+		if (path.length > 0) {
+			$racer.find(".current").text(formatTitle(path[path.length-1]));
+		}
+	}
+
+	function updateStatuses(standings) {
+		$.each(standings || [], function(i, standing) {
+			findRacer(standing["Name"]).find(".status").text(standing["Status"]);
+		});
+	}
+
+	var messageHandler = {
+		// visit
+		0: function(message) {
+			updatePath(message["Player"]);
+		},
+		// join
+		1: function(message) {
+			if (findRacer(message["Player"]["Name"]).length == 0) {
+				logMessage(message["PlayerName"] + " has joined the game.");
+			}
+			updatePath(message["Player"]);
+		},
+		// leave
+		2: function(message) {
+			findRacer(message["PlayerName"]).find(".status").text("gave up");
+			logMessage(message["PlayerName"] + " has left the game.");
+		},
+		// finish
+		3: function(message) {
+			updateStatuses(message["Standings"]);
+			logMessage(message["PlayerName"] + " reached the goal and leads for now.");
+		},
+		// game over
+		4: function(message) {
+			updateStatuses(message["Standings"]);
+			logMessage(message["PlayerName"] + " won the game!");
+		},
+		// checkpoint
+		8: function(message) {
+			logMessage(message["PlayerName"] + " passed checkpoint " + formatTitle(message["Message"]) + ".");
+		},
+		// hint
+		9: function(message) {
+			logMessage(message["PlayerName"] + " used a hint.");
+		},
+		// kick
+		10: function(message) {
+			findRacer(message["Kicked"]).find(".status").text("kicked");
+			logMessage(message["Kicked"] + " was kicked by the host.");
+		},
+		// host change
+		11: function(message) {
+			logMessage(message["Host"] + " is the new host.");
+		},
+		// game end
+		13: function(message) {
+			updateStatuses(message["Standings"]);
+			logMessage("The host ended the game.");
+		},
+		14: function(message) {
+			logMessage("The server is restarting, reload the page in a moment to keep watching.");
+		}
+	};
+
+	function handleMessage(message) {
+		// Workaround for http://code.google.com/p/go/issues/detail?id=7230
+		for (var k in message["GameMessage"]) {
+			message[k] = message["GameMessage"][k];
+		}
+
+		if (messageHandler[message.Type]) {
+			messageHandler[message.Type](message);
+		}
+	}
+
+	var sock = new WebSocket("ws://" + location.host + "/client?spectate=" + $("body").data("game") +
+		"&token=" + encodeURIComponent($("body").data("token") || ""));
+
+	sock.onmessage = function(m) {
+		handleMessage(JSON.parse(m.data));
+	}
+
+	sock.onclose = function(m) {
+		logMessage("Lost connection to the server.");
+	}
+});
@@ -0,0 +1,44 @@
+$(document).ready(function() {
+	// Fill the datalist of the input with titles from the selected wiki
+	// that start with what was typed so far.
+	function suggest($input) {
+		var query = $input.val();
+		var $list = $("#" + $input.attr("list"));
+
+		if (query.length < 2) {
+			return;
+		}
+
+		$.getJSON("/suggest", {wiki: $("#wikiLanguages").val(), q: query}, function(titles) {
+			// The user kept typing, these suggestions are outdated.
+			if ($input.val() !== query) {
+				return;
+			}
+
+			$list.empty();
+
+			$.each(titles, function(i, title) {
+				$list.append($("<option>").attr("value", title));
+			});
+		});
+	}
+
+	var timeout = null;
+
+	$("input.suggest").on("input", function() {
+		var $input = $(this);
+
+		clearTimeout(timeout);
+		timeout = setTimeout(function() { suggest($input); }, 200);
+	});
+
+	// An empty field means that a random page is chosen.
+	$("button.random").click(function() {
+		$($(this).data("target")).val("");
+	});
+
+	// Suggestions of one wiki don't make sense for another.
+	$("#wikiLanguages").change(function() {
+		$("datalist").empty();
+	});
+});
@@ -1,11 +1,18 @@
 $(document).ready(function() {
+	// In team races there is one list of players per team.
 	function getPlayerList() {
-		return $("#sidebar #players");
+		return $("#sidebar #players, #sidebar .team-players");
+	}
+
+	function getTeamPlayerList(team) {
+		return $("#sidebar .team-players").filter(function() {
+			return $(this).data("team") == team;
+		});
 	}
 
 	// [[Name1, Visits1, $(playerElement1)], ...]
-	function getPlayerListArray() {
-		return getPlayerList().find('li').map(function (i, e) {
+	function getPlayerListArray($list) {
+		return $list.find('li').map(function (i, e) {
 			var $this = $(this);
 
 			return {
@@ -30,6 +37,53 @@ $(document).ready(function() {
 		findPlayerElement(playerName).find(badgeTemplateSelector).remove();
 	}
 
+	// Replace the win badges of all players according to the standings
+	// sent by the server. The leader gets the winner badge when the game
+	// is over and the temporary winner badge otherwise.
+	function updateBadges(standings, isOver) {
+		getPlayerList().find(".winner, .temporary-winner").remove();
+
+		// Winners in team races are teams, not players.
+		if ($("#sidebar #teams").length > 0) {
+			return;
+		}
+
+		for (var i = 0; i < standings.length; i++) {
+			var standing = standings[i];
+
+			if (standing["Rank"] != 1 || standing["Status"] != "finished") {
+				continue;
+			}
+
+			var badge = isOver ? "#templates .winner" : "#templates .temporary-winner";
+
+			findPlayerElement(standing["Name"]).find(".visits").before($(badge).clone());
+		}
+	}
+
+	// Like updateBadges but for the teams of a team race.
+	function updateTeamBadges(teamStandings, isOver) {
+		if (!teamStandings) {
+			return;
+		}
+
+		$("#sidebar #teams .team").children(".winner, .temporary-winner").remove();
+
+		for (var i = 0; i < teamStandings.length; i++) {
+			var standing = teamStandings[i];
+
+			if (standing["Rank"] != 1 || standing["Status"] != "finished") {
+				continue;
+			}
+
+			var badge = isOver ? "#templates .winner" : "#templates .temporary-winner";
+
+			$("#sidebar #teams .team").filter(function() {
+				return $(this).data("team") == standing["Team"];
+			}).find("> b").after($(badge).clone());
+		}
+	}
+
 	function findPlayerElement(name) {
 		return getPlayerList().find("li").filter(function() {
 			return $(this).data("player") == name;
@@ -79,7 +133,7 @@ $(document).ready(function() {
 	//
 	// It is vital that the list of players IS ALREADY sorted.
 	function sortNewPlayerVisits(name) {
-		var playerArray = getPlayerListArray().toArray();
+		var playerArray = getPlayerListArray(findPlayerElement(name).parent()).toArray();
 
 		var currentIndex = indexOf(playerArray, function (e) {
 			return e.name == name;
@@ -141,7 +195,9 @@ $(document).ready(function() {
 
 		// Player not in list, add him and print to log.
 		if (findPlayerElement(player["Name"]).length == 0) {
-			getPlayerList().append(newPlayerElement(player["Name"]));
+			var $list = player["Team"] ? getTeamPlayerList(player["Team"]) : $("#sidebar #players");
+
+			$list.append(newPlayerElement(player["Name"]));
 
 			logMessage(player["Name"] + 'has joined game.');
 		}
@@ -187,7 +243,8 @@ $(document).ready(function() {
 			message["PlayerName"]
 		);
 
-		// TODO: add badge to winning player
+		updateBadges(message["Standings"], false);
+		updateTeamBadges(message["TeamStandings"], false);
 
 		logMessage(message["PlayerName"] + ' won the game for now.');
 	}
@@ -201,7 +258,8 @@ $(document).ready(function() {
 			message["PlayerName"]
 		);
 
-		// TODO: add badge to winning player
+		updateBadges(message["Standings"], true);
+		updateTeamBadges(message["TeamStandings"], true);
 
 		logMessage(message["PlayerName"] + ' won the game!');
 	}
@@ -209,6 +267,98 @@ $(document).ready(function() {
 	function fatalStuffHandler(message) {
 	}
 
+	// The host started the next round of the match, follow him.
+	function nextRoundHandler(message) {
+		window.location = "/match/play?id=" + message["Match"];
+	}
+
+	// Someone started a rematch of this game, everybody connected
+	// is part of it and follows.
+	function rematchHandler(message) {
+		logMessage(message["PlayerName"] + ' started a rematch.');
+
+		window.location = "/rematch?id=" + message["Previous"];
+	}
+
+	// Someone passed a checkpoint on the way to the goal.
+	function checkpointHandler(message) {
+		var checkpoint = message["Message"];
+
+		findPlayerElement(message["PlayerName"]).find(".checkpoints")
+			.text(message["Passed"] + "/" + message["Total"]);
+
+		if (message["PlayerName"] === message["RecipientName"]) {
+			$("#checkpoints li").filter(function() {
+				return $(this).data("checkpoint") == checkpoint;
+			}).append('<span class="passed">✓</span>');
+		}
+
+		logMessage(message["PlayerName"] + ' passed checkpoint ' + checkpoint.replace(/_/g, " ") + '.');
+	}
+
+	// Someone used a hint, only the count is known to the others.
+	function hintHandler(message) {
+		if (message["PlayerName"] !== message["RecipientName"]) {
+			logMessage(message["PlayerName"] + ' used a hint (+' + message["Penalty"] + ' clicks in total).');
+		}
+	}
+
+	// The host removed a player. The kicked player loses his session
+	// when reloading the game.
+	function kickHandler(message) {
+		if (message["Kicked"] === message["RecipientName"]) {
+			window.location.reload();
+			return;
+		}
+
+		findPlayerElement(message["Kicked"]).find(".visits")
+			.before('<span title="Kicked by the host." class="winflag badge kicked">🚫</span>');
+
+		logMessage(message["Kicked"] + ' was kicked by the host.');
+	}
+
+	function hostChangeHandler(message) {
+		// The old and the new host need other controls.
+		if (message["Host"] === message["RecipientName"] || message["PlayerName"] === message["RecipientName"]) {
+			window.location.reload();
+			return;
+		}
+
+		logMessage(message["Host"] + ' is the new host.');
+	}
+
+	function lockHandler(message) {
+		logMessage(message["Locked"] ? 'The host locked the game.' : 'The host unlocked the game.');
+	}
+
+	// The host ended the game, whoever leads now is the winner.
+	function gameEndHandler(message) {
+		updateBadges(message["Standings"], true);
+		updateTeamBadges(message["TeamStandings"], true);
+
+		$("#sidebar .give-up").replaceWith(
+			$('<a class="btn btn-primary rematch">Rematch</a>')
+				.attr("href", "/rematch?id=" + $("#spectate").data("game")));
+
+		if (message["Winner"]) {
+			logMessage('The host ended the game, ' + message["Winner"] + ' won!');
+		} else {
+			logMessage('The host ended the game without a winner.');
+		}
+	}
+
+	function restartHandler(message) {
+		logMessage('The server is restarting, reload the page in a moment to continue.');
+	}
+
+	$("button.hint").click(function() {
+		$.getJSON("/hint", {kind: $(this).data("kind")}, function(hint) {
+			$("#hints").append($("<li>").text(hint["Text"]));
+		}).fail(function() {
+			logMessage("No hint available right now.");
+		});
+	});
+
 	var messageHandler = {
 		0: visitHandler,
 		1: joinHandler,
@@ -216,6 +366,15 @@ $(document).ready(function() {
 		3: finishHandler,
 		4: gameOverHandler,
 		5: fatalStuffHandler,
+		6: nextRoundHandler,
+		7: rematchHandler,
+		8: checkpointHandler,
+		9: hintHandler,
+		10: kickHandler,
+		11: hostChangeHandler,
+		12: lockHandler,
+		13: gameEndHandler,
+		14: restartHandler,
 	};
 
 	function handleMessage(message) {
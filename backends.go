@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/diskv"
+	bolt "go.etcd.io/bbolt"
+	bolterrors "go.etcd.io/bbolt/errors"
+)
+
+// One file per key.
+type diskvBackend struct {
+	*diskv.Diskv
+}
+
+func newDiskvBackend(dir string, compressed bool) *diskvBackend {
+	options := diskv.Options{
+		BasePath: dir,
+
+		// Values are written to a temporary file first which then replaces
+		// the old file so that a crash can't leave a half written value.
+		// Has to be on the same file system but outside of BasePath.
+		TempDir: filepath.Clean(dir) + ".tmp",
+	}
+
+	if compressed {
+		options.Compression = diskv.NewGzipCompression()
+	}
+
+	return &diskvBackend{diskv.New(options)}
+}
+
+func (d *diskvBackend) Write(key string, value []byte) error {
+	return d.Diskv.WriteStream(key, bytes.NewReader(value), true)
+}
+
+func (d *diskvBackend) Keys(prefix string) ([]string, error) {
+	var keys []string
+
+	for key := range d.Diskv.KeysPrefix(prefix, nil) {
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+func (d *diskvBackend) Close() error {
+	return nil
+}
+
+// Values in a map, gone when the process ends.
+type memoryBackend struct {
+	values map[string][]byte
+	lock   sync.RWMutex
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{values: make(map[string][]byte)}
+}
+
+func (m *memoryBackend) Read(key string) ([]byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	value, ok := m.values[key]
+
+	if !ok {
+		return nil, fmt.Errorf("No value for key %s.", key)
+	}
+
+	return append([]byte(nil), value...), nil
+}
+
+func (m *memoryBackend) Write(key string, value []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.values[key] = append([]byte(nil), value...)
+
+	return nil
+}
+
+func (m *memoryBackend) Erase(key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.values[key]; !ok {
+		return fmt.Errorf("No value for key %s.", key)
+	}
+
+	delete(m.values, key)
+
+	return nil
+}
+
+func (m *memoryBackend) Has(key string) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	_, ok := m.values[key]
+
+	return ok
+}
+
+func (m *memoryBackend) Keys(prefix string) ([]string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	var keys []string
+
+	for key := range m.values {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+func (m *memoryBackend) Close() error {
+	return nil
+}
+
+var boltBucket = []byte("games")
+
+// All values in a single file database.
+type boltBackend struct {
+	db *bolt.DB
+}
+
+// The file is locked while it is open, opening it elsewhere fails with
+// errStoreInUse.
+func newBoltBackend(path string) (*boltBackend, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+
+	if err == bolterrors.ErrTimeout {
+		return nil, errStoreInUse
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltBackend{db}, nil
+}
+
+func (b *boltBackend) Read(key string) (value []byte, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltBucket).Get([]byte(key))
+
+		if v == nil {
+			return fmt.Errorf("No value for key %s.", key)
+		}
+
+		// The value is only valid during the transaction.
+		value = append([]byte(nil), v...)
+
+		return nil
+	})
+
+	return
+}
+
+func (b *boltBackend) Write(key string, value []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(key), value)
+	})
+}
+
+func (b *boltBackend) Erase(key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+
+		if bucket.Get([]byte(key)) == nil {
+			return fmt.Errorf("No value for key %s.", key)
+		}
+
+		return bucket.Delete([]byte(key))
+	})
+}
+
+func (b *boltBackend) Has(key string) bool {
+	found := false
+
+	b.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket(boltBucket).Get([]byte(key)) != nil
+		return nil
+	})
+
+	return found
+}
+
+func (b *boltBackend) Keys(prefix string) ([]string, error) {
+	var keys []string
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+
+		for k, _ := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, _ = c.Next() {
+			keys = append(keys, string(k))
+		}
+
+		return nil
+	})
+
+	return keys, err
+}
+
+func (b *boltBackend) Close() error {
+	return b.db.Close()
+}
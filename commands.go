@@ -0,0 +1,212 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// Maintenance subcommands of the server, run instead of the server
+// when given as first argument, e.g.
+//
+//	wikirace-serv migrate-store -from diskv:./games -to bolt:./games.db
+var commands = map[string]func(args []string) error{
+	"migrate-store":  migrateStoreCommand,
+	"migrate-schema": migrateSchemaCommand,
+	"export":         exportCommand,
+	"import":         importCommand,
+}
+
+// Copy everything from one store to another, e.g. to switch backends.
+func migrateStoreCommand(args []string) error {
+	flags := flag.NewFlagSet("migrate-store", flag.ExitOnError)
+
+	from := flags.String("from", "diskv:./games", "store to copy from")
+	to := flags.String("to", "", "store to copy to, e.g. bolt:./games.db")
+
+	flags.Parse(args)
+
+	if len(*to) == 0 {
+		return fmt.Errorf("No store to copy to given, see -help.")
+	}
+
+	source, err := OpenStore(*from)
+
+	if err != nil {
+		return err
+	}
+
+	defer source.Close()
+
+	target, err := OpenStore(*to)
+
+	if err != nil {
+		return err
+	}
+
+	defer target.Close()
+
+	n, err := source.CopyTo(target)
+
+	log.Printf("Copied %d values from %s to %s.\n", n, *from, *to)
+
+	return err
+}
+
+// Migrate the stored games to the current schema version. Games are
+// migrated when they are loaded anyway, this makes the stored files
+// readable by tools that don't know the old schema. Don't run it while
+// the server is running.
+func migrateSchemaCommand(args []string) error {
+	flags := flag.NewFlagSet("migrate-schema", flag.ExitOnError)
+
+	spec := flags.String("store", "diskv:./games", "store with the games to migrate")
+	dryRun := flags.Bool("dry-run", false, "only report what would be migrated")
+
+	flags.Parse(args)
+
+	store, err := OpenStore(*spec)
+
+	if err != nil {
+		return err
+	}
+
+	defer store.Close()
+
+	report, err := MigrateSchema(store, *dryRun)
+
+	fmt.Print(report)
+
+	if err == nil && len(report.Failed) > 0 {
+		err = fmt.Errorf("%d games could not be migrated.", len(report.Failed))
+	}
+
+	return err
+}
+
+// Format of the file, given by flag or by the extension of the file.
+func exportFormat(format, file string) string {
+	if len(format) == 0 && strings.HasSuffix(file, ".tar") {
+		return ExportTar
+	} else if len(format) == 0 {
+		return ExportJSONLines
+	}
+	return format
+}
+
+// Write selected games with their journals to a file, e.g.
+//
+//	wikirace-serv export -player alice -since 2024-05-01 -o alice.jsonl
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+
+	spec := flags.String("store", "diskv:./games", "store to export from")
+	output := flags.String("o", "-", "file to write, - for stdout")
+	format := flags.String("format", "", "jsonl or tar, by default taken from the file extension")
+	ids := flags.String("games", "", "comma separated hashes of the games to export")
+	player := flags.String("player", "", "only games the player took part in")
+	since := flags.String("since", "", "only games created on or after this day (YYYY-MM-DD)")
+	until := flags.String("until", "", "only games created on or before this day (YYYY-MM-DD)")
+
+	flags.Parse(args)
+
+	q := GameQuery{Player: *player}
+
+	if err := q.SetDays(*since, *until); err != nil {
+		return err
+	}
+
+	store, err := OpenStore(*spec)
+
+	if err != nil {
+		return err
+	}
+
+	defer store.Close()
+
+	var hashes []string
+
+	if len(*ids) > 0 {
+		hashes = strings.Split(*ids, ",")
+	}
+
+	hashes, err = SelectGames(store, hashes, q)
+
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+
+	if *output != "-" {
+		file, err := os.Create(*output)
+
+		if err != nil {
+			return err
+		}
+
+		defer file.Close()
+
+		w = file
+	}
+
+	n, err := ExportGames(store, hashes, w, exportFormat(*format, *output))
+
+	log.Printf("Exported %d games.\n", n)
+
+	return err
+}
+
+// Read games written by export into a store, e.g.
+//
+//	wikirace-serv import -i alice.jsonl
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+
+	spec := flags.String("store", "diskv:./games", "store to import into")
+	input := flags.String("i", "-", "file to read, - for stdin")
+	format := flags.String("format", "", "jsonl or tar, by default taken from the file extension")
+	overwrite := flags.Bool("overwrite", false, "replace games that already exist")
+
+	flags.Parse(args)
+
+	var r io.Reader = os.Stdin
+
+	if *input != "-" {
+		file, err := os.Open(*input)
+
+		if err != nil {
+			return err
+		}
+
+		defer file.Close()
+
+		r = file
+	}
+
+	// The server would not know about the imported games.
+	unlock, err := LockStore(*spec)
+
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	store, err := OpenStore(*spec)
+
+	if err != nil {
+		return err
+	}
+
+	defer store.Close()
+
+	hashes, err := ImportGames(store, r, exportFormat(*format, *input), *overwrite)
+
+	log.Printf("Imported %d games.\n", len(hashes))
+
+	return err
+}
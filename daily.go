@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/githubnemo/wikirace-serv/wikis"
+)
+
+// Time zone in which a new daily challenge starts at midnight.
+// Set in main().
+var dailyLocation = time.UTC
+
+// The daily race: one start and goal per wiki and day that everybody
+// races solo. The results of all players make up the leaderboard.
+type DailyChallenge struct {
+	// Day of the challenge in the daily time zone, e.g. 2006-01-02
+	Day string
+
+	Wiki  *wikis.Wiki
+	Start string
+	Goal  string
+
+	// Results of the players that reached the goal, ordered by rank.
+	Leaderboard []DailyResult
+
+	// Hash of the game of every player who started the challenge, by
+	// player name. Only the first attempt of a player counts.
+	Attempts map[string]string `json:",omitempty"`
+
+	// Lock for Leaderboard and Attempts
+	lock sync.Mutex
+
+	saveHandler func(*DailyChallenge)
+}
+
+// Result of a single player in the daily challenge.
+type DailyResult struct {
+	// Placement, tied players share a rank (1, 1, 3).
+	Rank int
+
+	Name string
+
+	// Same meaning as in Standing.
+	Clicks int
+	Score  int
+	Time   time.Duration
+
+	// Hash of the game the result was achieved in.
+	Game string
+
+	FinishedAt time.Time
+}
+
+// Day of the given time in the daily time zone.
+func DailyDay(now time.Time) string {
+	return now.In(dailyLocation).Format("2006-01-02")
+}
+
+// Key of the daily challenge in the store.
+func dailyKey(wiki *wikis.Wiki, day string) string {
+	return "daily-" + day + "-" + url.QueryEscape(wiki.URL)
+}
+
+// Seed for the start and goal of the daily challenge. Every server picks
+// the same pages for a wiki and day.
+func dailySeed(wiki *wikis.Wiki, day string) int64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(dailyKey(wiki, day)))
+
+	return int64(hash.Sum64())
+}
+
+func NewDailyChallenge(wiki *wikis.Wiki, day string, saveHandler func(*DailyChallenge)) *DailyChallenge {
+	return &DailyChallenge{Day: day, Wiki: wiki, saveHandler: saveHandler}
+}
+
+func (d *DailyChallenge) Key() string {
+	return dailyKey(d.Wiki, d.Day)
+}
+
+// Marshalled under the lock, daily challenges are written in the
+// background while they change.
+func (d *DailyChallenge) MarshalJSON() ([]byte, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	type dailyChallenge DailyChallenge
+
+	return json.Marshal((*dailyChallenge)(d))
+}
+
+func (d *DailyChallenge) save() {
+	if d.saveHandler != nil {
+		d.saveHandler(d)
+	}
+}
+
+// Result of the player with the given name, nil if he did not finish.
+func (d *DailyChallenge) Get(name string) *DailyResult {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for i := range d.Leaderboard {
+		if d.Leaderboard[i].Name == name {
+			r := d.Leaderboard[i]
+			return &r
+		}
+	}
+	return nil
+}
+
+// Whether somebody with that name started the challenge or is on the
+// leaderboard already. Only the first attempt of a player counts.
+func (d *DailyChallenge) HasPlayed(name string) bool {
+	d.lock.Lock()
+	_, started := d.Attempts[name]
+	d.lock.Unlock()
+
+	return started || d.Get(name) != nil
+}
+
+// Record the game as the attempt of the player. Returns false if the
+// player started the challenge before.
+func (d *DailyChallenge) addAttempt(name, hash string) bool {
+	if d.HasPlayed(name) {
+		return false
+	}
+
+	d.lock.Lock()
+
+	if _, started := d.Attempts[name]; started {
+		d.lock.Unlock()
+		return false
+	}
+
+	if d.Attempts == nil {
+		d.Attempts = make(map[string]string)
+	}
+
+	d.Attempts[name] = hash
+
+	d.lock.Unlock()
+
+	d.save()
+
+	return true
+}
+
+// Forget the attempt of the player, e.g. if the game could not be
+// created after all.
+func (d *DailyChallenge) removeAttempt(name string) {
+	d.lock.Lock()
+	delete(d.Attempts, name)
+	d.lock.Unlock()
+
+	d.save()
+}
+
+type sortableDailyResults []DailyResult
+
+func (s sortableDailyResults) Len() int      { return len(s) }
+func (s sortableDailyResults) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s sortableDailyResults) Less(i, j int) bool {
+	if s[i].Score != s[j].Score {
+		return s[i].Score < s[j].Score
+	}
+	if s[i].Time != s[j].Time {
+		return s[i].Time < s[j].Time
+	}
+	return s[i].FinishedAt.Before(s[j].FinishedAt)
+}
+
+func (s sortableDailyResults) tied(i, j int) bool {
+	return s[i].Score == s[j].Score && s[i].Time == s[j].Time
+}
+
+// Add the result of the finished player of the given daily game to the
+// leaderboard. Returns the result of the player, which is the first one
+// if he already is on the leaderboard.
+func (d *DailyChallenge) AddResult(game *Game, player *Player) DailyResult {
+	standing := game.Standings().Get(player.Name)
+
+	d.lock.Lock()
+
+	for _, r := range d.Leaderboard {
+		if r.Name == player.Name {
+			d.lock.Unlock()
+			return r
+		}
+	}
+
+	d.Leaderboard = append(d.Leaderboard, DailyResult{
+		Name:       player.Name,
+		Clicks:     standing.Clicks,
+		Score:      standing.Score,
+		Time:       standing.Time,
+		Game:       game.Hash(),
+		FinishedAt: player.LastVisitAt,
+	})
+
+	sort.Sort(sortableDailyResults(d.Leaderboard))
+
+	var result DailyResult
+
+	for i := range d.Leaderboard {
+		if i > 0 && sortableDailyResults(d.Leaderboard).tied(i-1, i) {
+			d.Leaderboard[i].Rank = d.Leaderboard[i-1].Rank
+		} else {
+			d.Leaderboard[i].Rank = i + 1
+		}
+
+		if d.Leaderboard[i].Name == player.Name {
+			result = d.Leaderboard[i]
+		}
+	}
+
+	d.lock.Unlock()
+
+	d.save()
+
+	return result
+}
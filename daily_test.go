@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/githubnemo/wikirace-serv/wikis"
+)
+
+func TestDailyLeaderboard(t *testing.T) {
+	game := simpleTwoPlayerGame()
+	game.hash = "daily game"
+
+	daily := NewDailyChallenge(game.Wiki, "2006-01-02", nil)
+
+	player1 := game.GetPlayer("player 1")
+	player2 := game.GetPlayer("player 2")
+
+	player1.Visited("other page")
+	player1.Visited(game.Goal)
+	player2.Visited(game.Goal)
+
+	daily.AddResult(game, player1)
+
+	if r := daily.AddResult(game, player2); r.Rank != 1 {
+		t.Errorf("player 2 took fewer clicks and should lead, got rank %d", r.Rank)
+	}
+
+	if r := daily.Get("player 1"); r == nil || r.Rank != 2 {
+		t.Errorf("player 1 should be second, got %#v", r)
+	}
+
+	// Only the first attempt counts.
+	player2.Visited("another page")
+	daily.AddResult(game, player2)
+
+	if len(daily.Leaderboard) != 2 || daily.Get("player 2").Clicks != 2 {
+		t.Errorf("a second attempt must not change the leaderboard: %#v", daily.Leaderboard)
+	}
+}
+
+func TestDailyDayUsesTimeZone(t *testing.T) {
+	defer func(loc *time.Location) { dailyLocation = loc }(dailyLocation)
+
+	now := time.Date(2006, 1, 2, 23, 30, 0, 0, time.UTC)
+
+	dailyLocation = time.FixedZone("UTC+1", 60*60)
+
+	if day := DailyDay(now); day != "2006-01-03" {
+		t.Errorf("expected the next day in UTC+1, got %s", day)
+	}
+}
+
+func TestDailyOnlyFirstAttempt(t *testing.T) {
+	defer func(old *GameStore) { gameStore = old }(gameStore)
+
+	gameStore = NewGameStore(NewMemoryStore(), NewMemoryStore())
+	wiki := &wikis.Wiki{URL: "http://wiki"}
+
+	daily := NewDailyChallenge(wiki, "2006-01-02", gameStore.dailySaveHandler)
+	daily.Start = "start page"
+	daily.Goal = "goal page"
+
+	if _, err := gameStore.NewDailyGame(daily, "player"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !daily.HasPlayed("player") {
+		t.Error("Started challenge does not count as played.")
+	}
+
+	// The game was not finished, still there is no second try.
+	if _, err := gameStore.NewDailyGame(daily, "player"); err == nil {
+		t.Error("Second attempt was not refused.")
+	}
+
+	if _, err := gameStore.NewDailyGame(daily, "other player"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDailySeed(t *testing.T) {
+	wiki := &wikis.Wiki{URL: "http://wiki"}
+	other := &wikis.Wiki{URL: "http://other.wiki"}
+
+	if dailySeed(wiki, "2006-01-02") != dailySeed(&wikis.Wiki{URL: "http://wiki"}, "2006-01-02") {
+		t.Error("Same wiki and day have different seeds.")
+	}
+
+	if dailySeed(wiki, "2006-01-02") == dailySeed(wiki, "2006-01-03") {
+		t.Error("Seed does not change with the day.")
+	}
+
+	if dailySeed(wiki, "2006-01-02") == dailySeed(other, "2006-01-02") {
+		t.Error("Seed does not change with the wiki.")
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"log"
 	"net/http"
 	"runtime/debug"
+
+	"github.com/githubnemo/wikirace-serv/wikis"
 )
 
 type UserFriendlyError interface {
@@ -27,14 +29,36 @@ func ErrStartAndGoal(e error) *stringUserFriendlyError {
 	return &stringUserFriendlyError{e, "I could not find where the wiki is in the intertubes."}
 }
 
+// Like ErrStartAndGoal but explains what is wrong with the pages
+// the host chose.
+func ErrChooseStartAndGoal(e error) *stringUserFriendlyError {
+	if nsp, ok := e.(*wikis.NoSuchPageError); ok {
+		return &stringUserFriendlyError{e, fmt.Sprintf("I could not find a page called %q in this wiki.", nsp.Title)}
+	}
+
+	if e == wikis.ErrSameStartAndGoal {
+		return &stringUserFriendlyError{e, "Start and goal are the same page, that would be a rather short race."}
+	}
+
+	return ErrStartAndGoal(e)
+}
+
 func ErrMalformedQuery(e error) *stringUserFriendlyError {
 	return &stringUserFriendlyError{e, "The stuff you typed in the URI I don't understand."}
 }
 
 func ErrGameMarshal(e error) *stringUserFriendlyError {
+	if e == errShuttingDown {
+		return ErrShuttingDown(e)
+	}
+
 	return &stringUserFriendlyError{e, "I could not save th1s game! M4ybe m_ disks a-re f-f-f---aulll-.."}
 }
 
+func ErrShuttingDown(e error) *stringUserFriendlyError {
+	return &stringUserFriendlyError{e, "The server is restarting, no new games for a moment. Try again in a minute."}
+}
+
 func ErrGetGameSession(e error) *stringUserFriendlyError {
 	return &stringUserFriendlyError{e, "Tried to get your game session but failed. Maybe you threw away your cookies? Who would do that to his cookies?!"}
 }
@@ -54,6 +78,242 @@ func ErrNoSuchGame(gameId string) *stringUserFriendlyError {
 	}
 }
 
+func ErrGameArchived(gameId string) *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Requested archived game %s", gameId),
+		fmt.Sprintf("The game %s is over and was archived. You can still look at the results at /spectate?id=%s.", gameId, gameId),
+	}
+}
+
+func ErrNoSuchMatch(matchId string) *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Requested invalid match %s", matchId),
+		fmt.Sprintf("There does not seem to be such a match as %s.", matchId),
+	}
+}
+
+func ErrNotInMatch(playerName, matchId string) *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Player %s is not in match %s", playerName, matchId),
+		"You are not playing in this match. Ask the host for the link to the current round to join it.",
+	}
+}
+
+func ErrNotHost(playerName string) *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Player %s is not the host", playerName),
+		"Only the host can do this.",
+	}
+}
+
+func ErrNoNextRound(matchId string) *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Match %s can't start a new round", matchId),
+		"The next round can't be started yet. Either the current round is still running or all rounds were played.",
+	}
+}
+
+func ErrGameNotOver(gameId string) *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Game %s is not over yet", gameId),
+		"The game is still running, finish it before asking for a rematch.",
+	}
+}
+
+func ErrTooFewTeams() *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Team race with less than two teams"),
+		"A team race needs at least two teams.",
+	}
+}
+
+func ErrNoSuchTeam(team string) *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Requested invalid team %s", team),
+		fmt.Sprintf("There is no team called %s in this game.", team),
+	}
+}
+
+func ErrForbiddenRules(e error) *stringUserFriendlyError {
+	return &stringUserFriendlyError{e, "The forbidden pages rules could not be understood. " + e.Error()}
+}
+
+func ErrForbiddenPage(page string) *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Visit of forbidden page %s", page),
+		fmt.Sprintf("The page %s is forbidden in this game. Go back and try another way.", page),
+	}
+}
+
+func ErrForbiddenStartOrGoal(page string) *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Start, goal or checkpoint %s is forbidden", page),
+		fmt.Sprintf("The page %s is start, goal or checkpoint of the game but also forbidden. Nobody could win this.", page),
+	}
+}
+
+func ErrHint(e error) *stringUserFriendlyError {
+	return &stringUserFriendlyError{e, "I could not come up with a hint, the wiki did not want to tell me."}
+}
+
+func ErrNotRacing(playerName string) *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Player %s is not racing", playerName),
+		"You are not in the race anymore.",
+	}
+}
+
+func ErrKicked(playerName string) *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Player %s was kicked", playerName),
+		"The host removed you from this game.",
+	}
+}
+
+func ErrKickHost() *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Host tried to kick himself"),
+		"You can't kick yourself. Make somebody else the host first.",
+	}
+}
+
+func ErrNoSuchPlayer(playerName string) *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("No player %s in game", playerName),
+		fmt.Sprintf("There is no player called %s in this game.", playerName),
+	}
+}
+
+func ErrGameLocked() *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Game is locked"),
+		"The host locked this game, nobody can join anymore.",
+	}
+}
+
+func ErrGameUnloaded(gameId string) *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Game %s was unloaded while in use", gameId),
+		"The game was idle for too long, please reload the page.",
+	}
+}
+
+func ErrGameEnded(gameId string) *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Game %s was ended by the host", gameId),
+		"The host ended this game.",
+	}
+}
+
+func ErrUnknownHostAction(action string) *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Unknown host action %q", action),
+		"I don't know what you want me to do.",
+	}
+}
+
+func ErrNoSuchWiki(wikiUrl string) *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Requested unknown wiki %s", wikiUrl),
+		"There is no such wiki to race in.",
+	}
+}
+
+func ErrNoSuchDaily(e error) *stringUserFriendlyError {
+	return &stringUserFriendlyError{e, "Today's daily race could not be loaded, try again later."}
+}
+
+func ErrDailyPlayed(playerName string) *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Player %s already played the daily race", playerName),
+		fmt.Sprintf("%s already played today's race. Only the first attempt counts, come back tomorrow!", playerName),
+	}
+}
+
+func ErrPrivateGame() *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Join of private game without credentials"),
+		"This game is private. You need the password or an invite link from the host to join.",
+	}
+}
+
+func ErrInvalidPassword(e error) *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Could not hash password of private game: %s", e),
+		"This password can't be used, please choose a shorter one.",
+	}
+}
+
+func ErrWrongPassword() *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Wrong password for private game"),
+		"The password is wrong.",
+	}
+}
+
+func ErrInvalidInvite() *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Invalid invite token"),
+		"The invite link is not valid (anymore). Ask the host for a new one.",
+	}
+}
+
+func ErrNameLength(min, max int) *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Name length not within %d and %d", min, max),
+		fmt.Sprintf("Your name must have between %d and %d characters.", min, max),
+	}
+}
+
+func ErrNameCharacters(name string) *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Name %q has invalid characters", name),
+		"Your name may only contain letters, digits, spaces and - _ . '",
+	}
+}
+
+func ErrNameReserved(name string) *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Name %q is reserved", name),
+		fmt.Sprintf("The name %s is reserved, please pick another one.", name),
+	}
+}
+
+func ErrNameProfane(name string) *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Name %q is profane", name),
+		"Please pick a nicer name.",
+	}
+}
+
+func ErrNameTaken(name string) *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Player name %q already taken", name),
+		fmt.Sprintf("There already is a player called %s in this game. Go back and pick another name.", name),
+	}
+}
+
+func ErrNameConfusable(name, other string) *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Player name %q looks like %q", name, other),
+		fmt.Sprintf("Your name looks too much like %s who is already in this game. Go back and pick another name.", other),
+	}
+}
+
+func ErrGameFull(max int) *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Game is full with %d players", max),
+		fmt.Sprintf("This game is full, it allows only %d players.", max),
+	}
+}
+
+func ErrGameHasWinner() *stringUserFriendlyError {
+	return &stringUserFriendlyError{
+		fmt.Errorf("Game is locked as it has already a winner"),
+		"This game already has a winner, you can't join anymore.",
+	}
+}
+
 func logError(err interface{}, r *http.Request) {
 	log.Println(
 		"panic catched:", err,
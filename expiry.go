@@ -0,0 +1,353 @@
+package main
+
+import (
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+// How long games are kept in memory, in the store and in the archive.
+// A zero duration disables the respective step.
+type ExpiryPolicy struct {
+	// Games and matches that were not requested for this long are
+	// dropped from memory unless somebody is still connected.
+	IdleTTL time.Duration
+
+	// Games that are over and were not changed for this long are moved
+	// to the archive.
+	ArchiveAfter time.Duration
+
+	// Games that are not over but were not changed for this long are
+	// considered abandoned and archived as well.
+	AbandonAfter time.Duration
+
+	// Archived games are deleted after this long.
+	Retention time.Duration
+}
+
+var DefaultExpiryPolicy = ExpiryPolicy{
+	IdleTTL:      30 * time.Minute,
+	ArchiveAfter: 1 * time.Hour,
+	AbandonAfter: 7 * 24 * time.Hour,
+	Retention:    30 * 24 * time.Hour,
+}
+
+// A game in the archive store.
+type ArchivedGame struct {
+	ArchivedAt time.Time
+	Game       *Game
+}
+
+// Whether the stored game is due for the archive. Games saved before
+// UpdatedAt existed count as idle for an unknown but long time.
+func (p ExpiryPolicy) shouldArchive(game GameSummary, now time.Time) bool {
+	idle := now.Sub(game.UpdatedAt)
+
+	if game.UpdatedAt.IsZero() {
+		idle = math.MaxInt64
+	}
+
+	if p.AbandonAfter > 0 && idle > p.AbandonAfter {
+		return true
+	}
+
+	return p.ArchiveAfter > 0 && idle > p.ArchiveAfter && game.StateAt(now) == GameOver
+}
+
+// Drop games and matches from memory that were not requested for longer
+// than the idle TTL. Games with connected clients stay. Dropped games are
+// retired, requests that still hold on to them fail.
+func (g *GameStore) Evict(policy ExpiryPolicy, now time.Time) {
+	if policy.IdleTTL == 0 {
+		return
+	}
+
+	g.activeLock.Lock()
+	defer g.activeLock.Unlock()
+
+	for hash, game := range g.activeGames {
+		if now.Sub(g.lastAccess[hash]) <= policy.IdleTTL {
+			continue
+		}
+
+		if !ClientHandler.Forget(hash) {
+			continue
+		}
+
+		// Unwritten changes would be lost if the game is loaded again.
+		// Checked by the owner, no change can sneak in afterwards.
+		if !game.retire(func() bool { return !g.isDirty(hash) }) {
+			continue
+		}
+
+		delete(g.activeGames, hash)
+		delete(g.lastAccess, hash)
+	}
+
+	for hash := range g.activeMatches {
+		if now.Sub(g.lastAccess[matchKey(hash)]) > policy.IdleTTL && !g.isDirty(matchKey(hash)) {
+			delete(g.activeMatches, hash)
+			delete(g.lastAccess, matchKey(hash))
+		}
+	}
+
+	for key := range g.activeDailies {
+		if now.Sub(g.lastAccess[key]) > policy.IdleTTL && !g.isDirty(key) {
+			delete(g.activeDailies, key)
+			delete(g.lastAccess, key)
+		}
+	}
+}
+
+// Move finished and abandoned games from the store to the archive.
+// Games that are active in memory are left alone. Matches are archived
+// once none of their rounds is left in the store. Daily challenges are
+// kept for their leaderboards.
+//
+// The games due are found by their summaries, only those are loaded.
+func (g *GameStore) ArchiveExpired(policy ExpiryPolicy, now time.Time) {
+	summaries, err := g.SummarizeGames(GameQuery{})
+
+	if err != nil {
+		log.Println("Could not list games for archiving:", err)
+		return
+	}
+
+	for _, summary := range summaries {
+		if policy.shouldArchive(summary, now) {
+			g.archiveIfExpired(summary.Hash, policy, now)
+		}
+	}
+
+	matches, err := g.Keys(matchKey(""))
+
+	if err != nil {
+		log.Println("Could not list matches for archiving:", err)
+		return
+	}
+
+	for _, key := range matches {
+		g.archiveMatch(key)
+	}
+}
+
+// Archive the stored game unless it is active. The game is claimed
+// until it is archived, so that it is not loaded meanwhile, see
+// GetGameByHash.
+func (g *GameStore) archiveIfExpired(hash string, policy ExpiryPolicy, now time.Time) {
+	g.activeLock.Lock()
+
+	_, active := g.activeGames[hash]
+	claimed := false
+
+	if !active {
+		_, claimed = g.claim(hash)
+	}
+
+	g.activeLock.Unlock()
+
+	if !claimed {
+		return
+	}
+
+	defer g.unclaim(hash)
+
+	game, err := g.loadGame(hash)
+
+	if err != nil {
+		log.Printf("Could not read game %s for archiving: %s\n", hash, err)
+		return
+	}
+
+	// The summary may be older than the game.
+	if !policy.shouldArchive(NewGameSummary(hash, game), now) {
+		return
+	}
+
+	if err := g.archiveGame(game, now); err != nil {
+		log.Printf("Could not archive game %s: %s\n", hash, err)
+	}
+}
+
+// The journal of the game is moved to the archive with it.
+func (g *GameStore) archiveGame(game *Game, now time.Time) error {
+	journal, err := readJournal(g.GameRepository, game.Hash(), 0)
+
+	if err != nil {
+		return err
+	}
+
+	if err := writeJournal(g.archive, game.Hash(), journal); err != nil {
+		return err
+	}
+
+	if err := g.archive.PutMarshal(game.Hash(), ArchivedGame{now, game}); err != nil {
+		return err
+	}
+
+	if err := g.Erase(game.Hash()); err != nil {
+		return err
+	}
+
+	return eraseJournal(g.GameRepository, game.Hash())
+}
+
+// Matches are small, they are deleted instead of archived.
+func (g *GameStore) archiveMatch(key string) {
+	hash := strings.TrimPrefix(key, matchKey(""))
+
+	g.activeLock.Lock()
+	_, active := g.activeMatches[hash]
+	g.activeLock.Unlock()
+
+	if active {
+		return
+	}
+
+	match := NewMatch("", nil, 0, nil)
+
+	if err := g.GetMarshal(key, match); err != nil {
+		log.Printf("Could not read match %s for archiving: %s\n", hash, err)
+		return
+	}
+
+	for _, round := range match.Rounds {
+		if g.Has(round) {
+			return
+		}
+	}
+
+	if err := g.Erase(key); err != nil {
+		log.Printf("Could not delete match %s: %s\n", hash, err)
+	}
+}
+
+// Delete archived games that are older than the retention period.
+func (g *GameStore) PurgeArchive(policy ExpiryPolicy, now time.Time) {
+	if policy.Retention == 0 {
+		return
+	}
+
+	keys, err := g.archive.Keys("")
+
+	if err != nil {
+		log.Println("Could not list archived games:", err)
+		return
+	}
+
+	for _, key := range keys {
+		if !isGameKey(key) {
+			continue
+		}
+
+		var archived ArchivedGame
+
+		if err := g.archive.GetMarshal(key, &archived); err != nil {
+			log.Printf("Could not read archived game %s: %s\n", key, err)
+			continue
+		}
+
+		if now.Sub(archived.ArchivedAt) <= policy.Retention {
+			continue
+		}
+
+		if err := g.archive.Erase(key); err != nil {
+			log.Printf("Could not delete archived game %s: %s\n", key, err)
+			continue
+		}
+
+		if err := eraseJournal(g.archive, key); err != nil {
+			log.Printf("Could not delete journal of archived game %s: %s\n", key, err)
+		}
+	}
+}
+
+// Summaries of the stored and the archived games matching the query,
+// ordered by hash. Games that are being archived are only listed once.
+func (g *GameStore) SummarizeAllGames(q GameQuery) ([]GameSummary, error) {
+	stored, err := g.SummarizeGames(q)
+
+	if err != nil {
+		return nil, err
+	}
+
+	archived, err := g.archive.SummarizeGames(q)
+
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := make([]GameSummary, 0, len(stored)+len(archived))
+
+	for len(stored) > 0 || len(archived) > 0 {
+		switch {
+		case len(archived) == 0 || len(stored) > 0 && stored[0].Hash < archived[0].Hash:
+			summaries, stored = append(summaries, stored[0]), stored[1:]
+		case len(stored) == 0 || archived[0].Hash < stored[0].Hash:
+			summaries, archived = append(summaries, archived[0]), archived[1:]
+		default:
+			summaries, stored, archived = append(summaries, stored[0]), stored[1:], archived[1:]
+		}
+	}
+
+	return summaries, nil
+}
+
+func (g *GameStore) IsArchived(hash string) bool {
+	return g.archive.Has(hash)
+}
+
+// The archived game with the given hash.
+func (g *GameStore) GetArchivedGame(hash string) (*ArchivedGame, error) {
+	archived := &ArchivedGame{Game: NewGame("", nil, nil)}
+
+	if err := g.archive.GetMarshal(hash, archived); err != nil {
+		return nil, err
+	}
+
+	archived.Game.hash = hash
+
+	return archived, nil
+}
+
+// Apply the policy once.
+func (g *GameStore) Expire(policy ExpiryPolicy, now time.Time) {
+	g.Evict(policy, now)
+	g.ArchiveExpired(policy, now)
+	g.PurgeArchive(policy, now)
+}
+
+// Apply the policy in the given interval until StopExpiry is called.
+func (g *GameStore) RunExpiry(policy ExpiryPolicy, interval time.Duration) {
+	g.expiryRunning.Lock()
+	defer g.expiryRunning.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		// Stopping wins over a pending tick.
+		select {
+		case <-g.expiryStop:
+			return
+		default:
+		}
+
+		select {
+		case now := <-ticker.C:
+			g.Expire(policy, now)
+		case <-g.expiryStop:
+			return
+		}
+	}
+}
+
+// Stop RunExpiry, waiting for a running expiry to finish. RunExpiry
+// returns right away if it is started afterwards.
+func (g *GameStore) StopExpiry() {
+	close(g.expiryStop)
+
+	g.expiryRunning.Lock()
+	g.expiryRunning.Unlock()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestArchiveAndPurgeExpiredGames(t *testing.T) {
+	games, archive := NewStore(t.TempDir()), NewCompressedStore(t.TempDir())
+	now := time.Now()
+
+	finished := simpleTwoPlayerGame()
+	finished.hash = "finished"
+	finished.GetPlayer("player 1").Visited(finished.Goal)
+	finished.GetPlayer("player 2").LeftGame = true
+
+	running := simpleTwoPlayerGame()
+	running.hash = "running"
+
+	for _, game := range []*Game{finished, running} {
+		if err := NewGameStore(games, archive).PutGame(game); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Put games are active, the games are expired as if the server had
+	// been restarted since.
+	store := NewGameStore(games, archive)
+
+	policy := ExpiryPolicy{ArchiveAfter: time.Hour, AbandonAfter: 24 * time.Hour, Retention: 48 * time.Hour}
+
+	store.Expire(policy, now.Add(2*time.Hour))
+
+	if store.Has("finished") || !store.IsArchived("finished") {
+		t.Errorf("finished game should have been archived")
+	}
+
+	if !store.Has("running") {
+		t.Errorf("running game should not have been archived yet")
+	}
+
+	archived, err := store.GetArchivedGame("finished")
+
+	if err != nil || archived.Game.Goal != finished.Goal {
+		t.Fatalf("archived game could not be read back: %v", err)
+	}
+
+	store.Expire(policy, now.Add(25*time.Hour))
+
+	if store.Has("running") || !store.IsArchived("running") {
+		t.Errorf("abandoned game should have been archived")
+	}
+
+	store.Expire(policy, now.Add(51*time.Hour))
+
+	if store.IsArchived("finished") {
+		t.Errorf("archived game should have been deleted after the retention period")
+	}
+}
+
+func TestStopExpiry(t *testing.T) {
+	store := NewGameStore(NewMemoryStore(), NewMemoryStore())
+
+	done := make(chan struct{})
+
+	go func() {
+		store.RunExpiry(DefaultExpiryPolicy, time.Millisecond)
+		close(done)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	store.StopExpiry()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expiry still runs after it was stopped.")
+	}
+
+	// Started too late, e.g. during the shutdown.
+	store.RunExpiry(DefaultExpiryPolicy, time.Millisecond)
+}
+
+// A game is not loaded while it is archived, it is gone afterwards.
+func TestLoadWhileArchiving(t *testing.T) {
+	repository := &slowRepository{Store: NewMemoryStore()}
+	now := time.Now()
+
+	game := simpleTwoPlayerGame()
+	game.hash = "slow"
+	game.GetPlayer("player 1").Visited(game.Goal)
+	game.GetPlayer("player 2").LeftGame = true
+
+	if err := NewGameStore(repository, NewMemoryStore()).PutGame(game); err != nil {
+		t.Fatal(err)
+	}
+
+	indexed, err := NewIndexedRepository(repository)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewGameStore(indexed, NewMemoryStore())
+
+	repository.reading = make(chan struct{}, 10)
+	repository.release = make(chan struct{})
+
+	archived := make(chan struct{})
+
+	go func() {
+		store.ArchiveExpired(ExpiryPolicy{ArchiveAfter: time.Hour}, now.Add(2*time.Hour))
+		close(archived)
+	}()
+
+	<-repository.reading
+
+	loaded := make(chan error)
+
+	go func() {
+		_, err := store.GetGameByHash("slow")
+		loaded <- err
+	}()
+
+	close(repository.release)
+	<-archived
+
+	if err := <-loaded; err == nil {
+		t.Error("Expected the archived game not to be loaded.")
+	}
+
+	if store.Has("slow") || !store.IsArchived("slow") {
+		t.Error("Expected the game to be archived.")
+	}
+}
+
+// Requests holding on to an evicted game can't change it anymore, the
+// game is loaded again instead.
+func TestEvictedGameRefusesCommands(t *testing.T) {
+	store := NewGameStore(NewMemoryStore(), NewMemoryStore())
+
+	game := simpleTwoPlayerGame()
+	game.hash = "game"
+
+	if err := store.PutGame(game); err != nil {
+		t.Fatal(err)
+	}
+
+	store.Evict(ExpiryPolicy{IdleTTL: time.Minute}, time.Now().Add(time.Hour))
+
+	func() {
+		defer func() {
+			if _, ok := recover().(*stringUserFriendlyError); !ok {
+				t.Error("Expected the evicted game to refuse the visit.")
+			}
+		}()
+
+		game.Visit(game.PlayerCopy("player 1"), "page")
+	}()
+
+	loaded, err := store.GetGameByHash("game")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded == game || len(loaded.PlayerCopy("player 1").Path) != 1 {
+		t.Error("Expected the game to be loaded again without the visit.")
+	}
+}
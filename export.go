@@ -0,0 +1,250 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Formats of exported games.
+const (
+	// One ExportedGame per line
+	ExportJSONLines = "jsonl"
+
+	// One file named <hash>.json per ExportedGame
+	ExportTar = "tar"
+)
+
+// A game with its hash and journal, as exported to move it to another
+// server.
+type ExportedGame struct {
+	Hash    string
+	Game    json.RawMessage
+	Journal []GameEvent `json:",omitempty"`
+}
+
+var gameHashPattern = regexp.MustCompile("^[0-9a-f]{40}$")
+
+// Check that the game can be imported: the hash looks like one of
+// ours, the game can be read, the journal is complete and reaches the
+// snapshot.
+func (e ExportedGame) validate() error {
+	if !gameHashPattern.MatchString(e.Hash) {
+		return fmt.Errorf("%q is not a game hash.", e.Hash)
+	}
+
+	game := NewGame("", nil, nil)
+
+	if err := json.Unmarshal(e.Game, game); err != nil {
+		return fmt.Errorf("Game %s can't be read: %s", e.Hash, err)
+	}
+
+	if !game.HasPlayer(game.Host) {
+		return fmt.Errorf("Host %q of game %s is no player.", game.Host, e.Hash)
+	}
+
+	// Compacted journals start later than the first event.
+	for i, event := range e.Journal {
+		if i > 0 && event.Seq != e.Journal[i-1].Seq+1 {
+			return fmt.Errorf("Event %d is missing in the journal of game %s.", e.Journal[i-1].Seq+1, e.Hash)
+		}
+	}
+
+	if len(e.Journal) > 0 && e.Journal[0].Type != EventCreated {
+		return fmt.Errorf("The journal of game %s does not start with its creation.", e.Hash)
+	}
+
+	// The game is loaded by replaying the journal after the snapshot,
+	// which must not be ahead of it.
+	last := 0
+
+	if len(e.Journal) > 0 {
+		last = e.Journal[len(e.Journal)-1].Seq
+	}
+
+	if game.JournalSeq > last {
+		return fmt.Errorf("The journal of game %s ends with event %d before its snapshot at event %d.", e.Hash, last, game.JournalSeq)
+	}
+
+	return nil
+}
+
+// Hashes of the stored games matching the query, or the given hashes
+// if there are any. Given hashes have to exist.
+func SelectGames(store *Store, hashes []string, q GameQuery) ([]string, error) {
+	if len(hashes) == 0 {
+		return store.QueryGames(q)
+	}
+
+	for _, hash := range hashes {
+		if !isGameKey(hash) || !store.Has(hash) {
+			return nil, fmt.Errorf("There is no game %s.", hash)
+		}
+	}
+
+	return hashes, nil
+}
+
+// Write the games with the given hashes and their journals in the
+// given format. Returns the number of exported games.
+func ExportGames(store *Store, hashes []string, w io.Writer, format string) (int, error) {
+	var archive *tar.Writer
+
+	switch format {
+	case ExportJSONLines:
+	case ExportTar:
+		archive = tar.NewWriter(w)
+	default:
+		return 0, fmt.Errorf("Unknown export format %q.", format)
+	}
+
+	for i, hash := range hashes {
+		game, err := store.Read(hash)
+
+		if err != nil {
+			return i, err
+		}
+
+		journal, err := readJournal(store, hash, 0)
+
+		if err != nil {
+			return i, err
+		}
+
+		data, err := json.Marshal(ExportedGame{hash, game, journal})
+
+		if err != nil {
+			return i, err
+		}
+
+		if archive == nil {
+			_, err = w.Write(append(data, '\n'))
+		} else {
+			err = archive.WriteHeader(&tar.Header{
+				Name:    hash + ".json",
+				Mode:    0644,
+				Size:    int64(len(data)),
+				ModTime: time.Now(),
+			})
+
+			if err == nil {
+				_, err = archive.Write(data)
+			}
+		}
+
+		if err != nil {
+			return i, err
+		}
+	}
+
+	if archive != nil {
+		return len(hashes), archive.Close()
+	}
+
+	return len(hashes), nil
+}
+
+func readExportedGames(r io.Reader, format string) ([]ExportedGame, error) {
+	var games []ExportedGame
+
+	switch format {
+	case ExportJSONLines:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 64<<20)
+
+		for line := 1; scanner.Scan(); line++ {
+			if len(strings.TrimSpace(scanner.Text())) == 0 {
+				continue
+			}
+
+			var game ExportedGame
+
+			if err := json.Unmarshal(scanner.Bytes(), &game); err != nil {
+				return nil, fmt.Errorf("Line %d: %s", line, err)
+			}
+
+			games = append(games, game)
+		}
+
+		return games, scanner.Err()
+
+	case ExportTar:
+		archive := tar.NewReader(r)
+
+		for {
+			header, err := archive.Next()
+
+			if err == io.EOF {
+				return games, nil
+			} else if err != nil {
+				return nil, err
+			}
+
+			var game ExportedGame
+
+			if err := json.NewDecoder(archive).Decode(&game); err != nil {
+				return nil, fmt.Errorf("%s: %s", header.Name, err)
+			}
+
+			games = append(games, game)
+		}
+	}
+
+	return nil, fmt.Errorf("Unknown export format %q.", format)
+}
+
+// Read exported games and store them under their hashes. Nothing is
+// stored unless all games are valid. Games that are already stored are
+// only replaced if overwrite is set. Returns the hashes of the imported
+// games.
+//
+// The games are written to the store directly. A server using the store
+// would neither index them nor know their versions, which is why the
+// import command locks the store first, see LockStore.
+func ImportGames(store *Store, r io.Reader, format string, overwrite bool) ([]string, error) {
+	games, err := readExportedGames(r, format)
+
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+
+	for _, game := range games {
+		if err := game.validate(); err != nil {
+			return nil, err
+		}
+
+		if seen[game.Hash] {
+			return nil, fmt.Errorf("Game %s is exported twice.", game.Hash)
+		}
+
+		seen[game.Hash] = true
+
+		if !overwrite && store.Has(game.Hash) {
+			return nil, fmt.Errorf("Game %s already exists.", game.Hash)
+		}
+	}
+
+	var hashes []string
+
+	for _, game := range games {
+		if err := writeJournal(store, game.Hash, game.Journal); err != nil {
+			return hashes, err
+		}
+
+		// Written as is, the version of the game is kept.
+		if err := store.Write(game.Hash, game.Game); err != nil {
+			return hashes, err
+		}
+
+		hashes = append(hashes, game.Hash)
+	}
+
+	return hashes, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const (
+	exportHash1 = "1111111111111111111111111111111111111111"
+	exportHash2 = "2222222222222222222222222222222222222222"
+)
+
+func exportTestStore(t *testing.T) *Store {
+	store := NewMemoryStore()
+
+	for hash, host := range map[string]string{exportHash1: "alice", exportHash2: "bob"} {
+		game := NewGame(host, nil, nil)
+		game.hash = hash
+
+		if err := store.PutMarshal(hash, game); err != nil {
+			t.Fatal(err)
+		}
+
+		store.PutMarshal(journalKey(hash), []GameEvent{{Seq: 1, Type: EventCreated, Data: eventData(game)}})
+	}
+
+	return store
+}
+
+func TestExportAndImport(t *testing.T) {
+	for _, format := range []string{ExportJSONLines, ExportTar} {
+		source := exportTestStore(t)
+
+		hashes, err := SelectGames(source, nil, GameQuery{Player: "alice"})
+
+		if err != nil || len(hashes) != 1 || hashes[0] != exportHash1 {
+			t.Fatalf("%s: wrong games selected: %v %v", format, hashes, err)
+		}
+
+		var buf bytes.Buffer
+
+		if n, err := ExportGames(source, hashes, &buf, format); err != nil || n != 1 {
+			t.Fatalf("%s: export failed: %d %v", format, n, err)
+		}
+
+		target := NewMemoryStore()
+
+		imported, err := ImportGames(target, bytes.NewReader(buf.Bytes()), format, false)
+
+		if err != nil || len(imported) != 1 {
+			t.Fatalf("%s: import failed: %v %v", format, imported, err)
+		}
+
+		game := NewGame("", nil, nil)
+
+		if err := target.GetMarshal(exportHash1, game); err != nil || game.Host != "alice" || game.Version != 1 {
+			t.Errorf("%s: game not imported as exported: %+v %v", format, game, err)
+		}
+
+		if journal, _ := readJournal(target, exportHash1, 0); len(journal) != 1 {
+			t.Errorf("%s: journal not imported: %v", format, journal)
+		}
+
+		if _, err := ImportGames(target, bytes.NewReader(buf.Bytes()), format, false); err == nil {
+			t.Errorf("%s: existing game was overwritten.", format)
+		}
+
+		if _, err := ImportGames(target, bytes.NewReader(buf.Bytes()), format, true); err != nil {
+			t.Errorf("%s: overwrite failed: %v", format, err)
+		}
+	}
+}
+
+func TestImportValidatesGames(t *testing.T) {
+	invalid := map[string]string{
+		"hash":    `{"Hash": "../games", "Game": {"Host": "a", "Players": [{"Name": "a"}]}}`,
+		"host":    `{"Hash": "` + exportHash1 + `", "Game": {"Host": "a", "Players": [{"Name": "b"}]}}`,
+		"journal": `{"Hash": "` + exportHash1 + `", "Game": {"Host": "a", "Players": [{"Name": "a"}]}, "Journal": [{"Seq": 2, "Type": "lock"}]}`,
+		"schema":  `{"Hash": "` + exportHash1 + `", "Game": {"Schema": 1000}}`,
+		"seq":     `{"Hash": "` + exportHash1 + `", "Game": {"Host": "a", "Players": [{"Name": "a"}], "JournalSeq": 3}, "Journal": [{"Seq": 1, "Type": "created"}]}`,
+	}
+
+	valid := `{"Hash": "` + exportHash2 + `", "Game": {"Host": "a", "Players": [{"Name": "a"}]}}`
+
+	for name, line := range invalid {
+		store := NewMemoryStore()
+
+		if _, err := ImportGames(store, strings.NewReader(valid+"\n"+line+"\n"), ExportJSONLines, false); err == nil {
+			t.Errorf("Game with invalid %s was imported.", name)
+		}
+
+		if keys, _ := store.Keys(""); len(keys) != 0 {
+			t.Errorf("Games were imported although the %s of one is invalid: %v", name, keys)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/githubnemo/wikirace-serv/wikis"
+)
+
+// Categories of pages change rarely but every visited page links
+// hundreds of pages, so they are only looked up once in a while.
+var forbiddenCategories = newCategoryCache(time.Hour, 100000)
+
+// House rules of a game that ban pages, typically hub articles
+// like "United States", so that the race does not get too easy.
+type ForbiddenPages struct {
+	// Titles of forbidden pages
+	Pages []string
+
+	// Regular expressions matched against the titles of pages
+	Patterns []string
+
+	// Pages in one of these categories are forbidden
+	Categories []string
+
+	// Patterns are compiled on first use
+	compiled    []*regexp.Regexp
+	compileLock sync.Mutex
+}
+
+// Split the multi-line form values into the rules. Each line is one
+// page, pattern or category. Patterns are validated.
+func ParseForbiddenPages(pages, patterns, categories string) (*ForbiddenPages, error) {
+	f := &ForbiddenPages{
+		Pages:      splitLines(pages),
+		Patterns:   splitLines(patterns),
+		Categories: splitLines(categories),
+	}
+
+	return f, f.compile()
+}
+
+func splitLines(text string) []string {
+	var lines []string
+
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
+
+func (f *ForbiddenPages) compile() error {
+	f.compileLock.Lock()
+	defer f.compileLock.Unlock()
+
+	if len(f.compiled) == len(f.Patterns) {
+		return nil
+	}
+
+	f.compiled = nil
+
+	for _, pattern := range f.Patterns {
+		re, err := regexp.Compile(pattern)
+
+		if err != nil {
+			return fmt.Errorf("Invalid pattern %q: %s", pattern, err)
+		}
+
+		f.compiled = append(f.compiled, re)
+	}
+
+	return nil
+}
+
+// A nil *ForbiddenPages is empty and forbids nothing.
+func (f *ForbiddenPages) IsEmpty() bool {
+	return f == nil || len(f.Pages) == 0 && len(f.Patterns) == 0 && len(f.Categories) == 0
+}
+
+// Whether the page is forbidden by title or pattern.
+func (f *ForbiddenPages) matchesTitle(title string) bool {
+	for _, page := range f.Pages {
+		if wikis.SamePage(page, title) {
+			return true
+		}
+	}
+
+	// Patterns were validated when the game was created. If that fails
+	// now the stored game was modified, so better forbid everything.
+	if err := f.compile(); err != nil {
+		return true
+	}
+
+	for _, re := range f.compiled {
+		if re.MatchString(wikis.NormalizeTitle(title)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *ForbiddenPages) matchesCategories(categories []string) bool {
+	for _, c := range categories {
+		for _, forbidden := range f.Categories {
+			if wikis.SamePage(c, forbidden) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The subset of pages that are forbidden. Categories are only looked up
+// for pages that are not forbidden by title already. If the lookup
+// fails the pages are allowed, a broken wiki API must not stop the
+// race. Can be used as wikis.LinkFilter.
+func (f *ForbiddenPages) Filter(wiki *wikis.Wiki, pages []string) (map[string]bool, error) {
+	forbidden := make(map[string]bool)
+
+	if f.IsEmpty() {
+		return forbidden, nil
+	}
+
+	var unknown []string
+
+	for _, page := range pages {
+		if f.matchesTitle(page) {
+			forbidden[page] = true
+		} else {
+			unknown = append(unknown, page)
+		}
+	}
+
+	if len(f.Categories) == 0 || len(unknown) == 0 {
+		return forbidden, nil
+	}
+
+	categories, err := forbiddenCategories.Get(wiki, unknown)
+
+	if err != nil {
+		log.Println("Error looking up categories of forbidden pages:", err)
+		return forbidden, nil
+	}
+
+	for _, page := range unknown {
+		if f.matchesCategories(categories[page]) {
+			forbidden[page] = true
+		}
+	}
+
+	return forbidden, nil
+}
+
+// Whether the single page is forbidden.
+func (f *ForbiddenPages) IsForbidden(wiki *wikis.Wiki, page string) (bool, error) {
+	forbidden, err := f.Filter(wiki, []string{page})
+
+	if err != nil {
+		return false, err
+	}
+
+	return forbidden[page], nil
+}
+
+// Categories of pages by wiki and title, see wikis.PageCategories.
+// Entries are looked up again after the TTL. When the cache is full it
+// is emptied.
+type categoryCache struct {
+	ttl     time.Duration
+	size    int
+	entries map[categoryKey]cachedCategories
+
+	// Lock for entries
+	lock sync.Mutex
+}
+
+type categoryKey struct {
+	wiki  string
+	title string
+}
+
+type cachedCategories struct {
+	categories []string
+	expires    time.Time
+}
+
+func newCategoryCache(ttl time.Duration, size int) *categoryCache {
+	return &categoryCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[categoryKey]cachedCategories),
+	}
+}
+
+// Categories of the pages, keyed by the titles as given. Only pages
+// that are not cached are looked up.
+func (c *categoryCache) Get(wiki *wikis.Wiki, titles []string) (map[string][]string, error) {
+	categories := make(map[string][]string)
+	now := time.Now()
+
+	var missing []string
+
+	c.lock.Lock()
+
+	for _, title := range titles {
+		entry, ok := c.entries[categoryKey{wiki.URL, wikis.NormalizeTitle(title)}]
+
+		if ok && now.Before(entry.expires) {
+			categories[title] = entry.categories
+		} else {
+			missing = append(missing, title)
+		}
+	}
+
+	c.lock.Unlock()
+
+	if len(missing) == 0 {
+		return categories, nil
+	}
+
+	found, err := wiki.PageCategories(missing, true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.entries)+len(missing) > c.size {
+		c.entries = make(map[categoryKey]cachedCategories)
+	}
+
+	for _, title := range missing {
+		categories[title] = found[title]
+		c.entries[categoryKey{wiki.URL, wikis.NormalizeTitle(title)}] = cachedCategories{found[title], now.Add(c.ttl)}
+	}
+
+	return categories, nil
+}
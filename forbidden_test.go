@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/githubnemo/wikirace-serv/wikis"
+)
+
+func TestForbiddenPagesByTitleAndPattern(t *testing.T) {
+	forbidden, err := ParseForbiddenPages("United States\n\n Germany ", "^List of", "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pages := []string{"United_States", "Germany", "List_of_lists", "Philosophy"}
+
+	result, err := forbidden.Filter(nil, pages)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, page := range pages[:3] {
+		if !result[page] {
+			t.Errorf("%s should be forbidden", page)
+		}
+	}
+
+	if result["Philosophy"] {
+		t.Errorf("Philosophy should not be forbidden")
+	}
+}
+
+func TestForbiddenPagesInvalidPattern(t *testing.T) {
+	if _, err := ParseForbiddenPages("", "(unclosed", ""); err == nil {
+		t.Errorf("expected an error for an invalid pattern")
+	}
+}
+
+func TestNoForbiddenPages(t *testing.T) {
+	var forbidden *ForbiddenPages
+
+	if isForbidden, err := forbidden.IsForbidden(nil, "United States"); err != nil || isForbidden {
+		t.Errorf("nil rules must not forbid anything, got %t, %v", isForbidden, err)
+	}
+}
+
+func TestForbiddenCategoriesAreCached(t *testing.T) {
+	defer func(old *categoryCache) { forbiddenCategories = old }(forbiddenCategories)
+
+	forbiddenCategories = newCategoryCache(time.Hour, 10)
+
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"query":{"pages":{"1":{"title":"Germany","categories":[{"title":"Category:Countries"}]}}}}`))
+	}))
+	defer server.Close()
+
+	wiki := &wikis.Wiki{URL: server.URL}
+	forbidden, _ := ParseForbiddenPages("", "", "Countries")
+
+	for i := 0; i < 3; i++ {
+		if isForbidden, err := forbidden.IsForbidden(wiki, "Germany"); err != nil || !isForbidden {
+			t.Errorf("Germany should be forbidden by category, got %t, %v", isForbidden, err)
+		}
+	}
+
+	if requests != 1 {
+		t.Errorf("Expected the categories to be looked up once, got %d requests.", requests)
+	}
+}
+
+func TestForbiddenCategoriesLookupFails(t *testing.T) {
+	defer func(old *categoryCache) { forbiddenCategories = old }(forbiddenCategories)
+
+	forbiddenCategories = newCategoryCache(time.Hour, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	wiki := &wikis.Wiki{URL: server.URL}
+	forbidden, _ := ParseForbiddenPages("United States", "", "Countries")
+
+	result, err := forbidden.Filter(wiki, []string{"United States", "Germany"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !result["United States"] || result["Germany"] {
+		t.Errorf("Only pages forbidden by title should be forbidden, got %v", result)
+	}
+}
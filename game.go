@@ -1,9 +1,8 @@
 package main
 
 import (
-	"fmt"
 	"sort"
-	"sync"
+	"time"
 
 	"github.com/githubnemo/wikirace-serv/wikis"
 )
@@ -32,14 +31,92 @@ type Game struct {
 	Start string
 	Goal  string
 
-	// Lock for Winner / WinnerPath
-	winnerLock sync.RWMutex
+	// Names of the teams racing against each other. Empty if every
+	// player races for himself.
+	Teams []string
 
-	// Lock for Players
-	playerLock sync.RWMutex
+	// How the results of team members make up the team result.
+	TeamScoring TeamScoring
+
+	// Pages that may not be visited in this game. Nil if all pages
+	// are allowed.
+	Forbidden *ForbiddenPages
+
+	// Hash of the match this game is a round of. Empty if the game
+	// is not part of a match.
+	Match string
+
+	// Key of the daily challenge this game is an attempt at. Empty if
+	// the game is no daily race.
+	Daily string
+
+	// Hash of the game that was started as a rematch of this game.
+	// Empty if there was no rematch yet.
+	Rematch string
+
+	// Pages every player has to pass before the goal counts. If
+	// CheckpointsInOrder is set they have to be passed in this order.
+	Checkpoints        []string
+	CheckpointsInOrder bool
+
+	// Clicks added to the score of a player for every hint used.
+	HintPenalty int
+
+	// Players that did not reach the goal within this duration are out
+	// of the race. Zero means there is no time limit.
+	TimeLimit time.Duration
+
+	// Set by the host to prevent new players from joining.
+	Locked bool
+
+	// Maximum number of players, kicked players don't count. Zero if
+	// there is no limit.
+	MaxPlayers int
+
+	// Private games can only be joined with the invite token or the
+	// password, if there is one. Only the bcrypt hash of the password
+	// is stored, PasswordSalt is only set for games with the salted
+	// SHA-256 hash used before. The invite token is derived from
+	// InviteNonce, see InviteToken.
+	Private      bool
+	PasswordSalt string `json:",omitempty"`
+	PasswordHash string `json:",omitempty"`
+	InviteNonce  string `json:",omitempty"`
+
+	// Set when the host ended the game early. Players that did not
+	// reach the goal until then are out of the race.
+	Ended bool
+
+	// Zero for games created before this was recorded.
+	CreatedAt time.Time
+
+	// Incremented on every save. A game is only saved if it has the
+	// version that is stored, see Store.PutMarshal.
+	Version int
+
+	// Format of the stored game, see GameSchemaVersion.
+	Schema int
+
+	// Sequence number of the last journal event included in this
+	// game. Zero if the journal was not started yet, see startJournal.
+	JournalSeq int
+
+	// Time of the last change that was saved. Used to decide when the
+	// game is archived.
+	UpdatedAt time.Time
+
+	// Standings at the time the game was last saved. This is only meant
+	// for readers of the stored game, use Standings() for live data.
+	Results Standings
+
+	// Runs the commands of the game while it is active, see Do.
+	owner *gameOwner
 
 	// Called every time changes that are worth saving to disk are made
 	saveHandler func(*Game)
+
+	// Called with every change once the journal is started
+	journalHandler func(*Game, GameEvent)
 }
 
 // Usually not called directly as the save handler is relevant to the
@@ -49,6 +126,9 @@ func NewGame(hostingPlayerName string, wiki *wikis.Wiki, saveHandler func(*Game)
 	game := &Game{
 		Host:        hostingPlayerName,
 		Wiki:        wiki,
+		CreatedAt:   time.Now(),
+		Schema:      GameSchemaVersion,
+		owner:       &gameOwner{},
 		saveHandler: saveHandler,
 	}
 
@@ -57,14 +137,19 @@ func NewGame(hostingPlayerName string, wiki *wikis.Wiki, saveHandler func(*Game)
 	return game
 }
 
+func (g *Game) version() *int {
+	return &g.Version
+}
+
 func (g *Game) save() {
 	if g.saveHandler != nil {
+		g.Results = g.standingsAt(time.Now())
 		g.saveHandler(g)
 	}
 }
 
 func (g *Game) Broadcast(msg GameMessage) {
-	ClientHandler.Broadcast(g, msg)
+	ClientHandler.Broadcast(g.Hash(), msg)
 }
 
 func (g *Game) Hash() string {
@@ -76,20 +161,86 @@ func (g *Game) Hash() string {
 }
 
 func (g *Game) AddPlayer(name string) {
-	g.playerLock.Lock()
-	defer g.playerLock.Unlock()
+	g.AddPlayerToTeam(name, "")
+}
+
+// Add the player to the given team. If the team is empty and the game has
+// teams, the player is assigned to the team with the fewest members.
+func (g *Game) AddPlayerToTeam(name, team string) {
+	g.Do(func() {
+		g.change(GameEvent{Type: EventJoin, Player: name, Data: eventData(team)})
+	})
+}
+
+func (g *Game) addPlayer(name, team string, at time.Time) {
+	if len(team) == 0 {
+		team = g.smallestTeam()
+	}
 
 	g.Players = append(g.Players, Player{
-		Name: name,
+		Name:     name,
+		Team:     team,
+		JoinedAt: at,
 	})
+}
 
-	g.save()
+func (g *Game) HasTeams() bool {
+	return len(g.Teams) > 0
 }
 
-func (g *Game) GetPlayer(name string) *Player {
-	g.playerLock.RLock()
-	defer g.playerLock.RUnlock()
+func (g *Game) HasTeam(team string) bool {
+	for _, e := range g.Teams {
+		if e == team {
+			return true
+		}
+	}
+	return false
+}
+
+// The team with the fewest members, empty if there are no teams.
+func (g *Game) smallestTeam() string {
+	smallest, size := "", -1
 
+	for _, team := range g.Teams {
+		n := 0
+
+		for _, p := range g.Players {
+			if p.Team == team {
+				n++
+			}
+		}
+
+		if size < 0 || n < size {
+			smallest, size = team, n
+		}
+	}
+
+	return smallest
+}
+
+// Turn the game into a team race. Players already in the game are
+// distributed among the teams.
+func (g *Game) SetTeams(teams []string, scoring TeamScoring) {
+	g.Do(func() {
+		g.change(GameEvent{Type: EventTeams, Data: eventData(teamsEventData{teams, scoring})})
+	})
+}
+
+func (g *Game) setTeams(teams []string, scoring TeamScoring) {
+	g.Teams = teams
+	g.TeamScoring = scoring
+
+	for i := range g.Players {
+		if !g.HasTeam(g.Players[i].Team) {
+			g.Players[i].Team = g.smallestTeam()
+		}
+	}
+}
+
+// The player in the game, nil if there is none. Changes to the player
+// change the game: only use it in commands or on games without owner,
+// see Do. Use PlayerCopy everywhere else.
+func (g *Game) GetPlayer(name string) *Player {
 	for i, e := range g.Players {
 		if e.Name == name {
 			return &g.Players[i]
@@ -98,68 +249,303 @@ func (g *Game) GetPlayer(name string) *Player {
 	return nil
 }
 
-func (g *Game) HasPlayer(name string) bool {
-	g.playerLock.RLock()
-	defer g.playerLock.RUnlock()
+// A copy of the player as it is now, nil if there is none.
+func (g *Game) PlayerCopy(name string) (player *Player) {
+	g.Do(func() {
+		if p := g.GetPlayer(name); p != nil {
+			copied := *p
+			player = &copied
+		}
+	})
 
-	for _, e := range g.Players {
-		if e.Name == name {
-			return true
+	return
+}
+
+func (g *Game) HasPlayer(name string) (found bool) {
+	g.Do(func() {
+		found = g.GetPlayer(name) != nil
+	})
+
+	return
+}
+
+// Copies of the players, sorted.
+func (g *Game) SortedPlayers() (players []Player) {
+	g.Do(func() {
+		players = append(players, g.Players...)
+	})
+
+	sort.Sort(SortablePlayers(players))
+
+	return
+}
+
+func (g *Game) setWinner(player *Player) {
+	g.change(GameEvent{Type: EventWin, Player: player.Name})
+}
+
+// Compute the current standings of all players. Does not modify the game.
+func (g *Game) Standings() Standings {
+	return g.StandingsAt(time.Now())
+}
+
+// Compute the standings of all players as they are at the given time.
+func (g *Game) StandingsAt(now time.Time) (standings Standings) {
+	g.Do(func() {
+		standings = g.standingsAt(now)
+	})
+
+	return
+}
+
+func (g *Game) standingsAt(now time.Time) Standings {
+	return ComputeStandings(g.Players, g.rules(), now)
+}
+
+func (g *Game) Rules() (rules RaceRules) {
+	g.Do(func() {
+		rules = g.rules()
+	})
+
+	return
+}
+
+func (g *Game) rules() RaceRules {
+	return RaceRules{
+		Goal:        g.Goal,
+		Checkpoints: g.Checkpoints,
+		TimeLimit:   g.TimeLimit,
+		HintPenalty: g.HintPenalty,
+		Ended:       g.Ended,
+	}
+}
+
+// Record the hint the player used. Adds the hint penalty to his score.
+func (g *Game) AddHint(player *Player, hint Hint) {
+	g.Do(func() {
+		g.change(GameEvent{Type: EventHint, Player: player.Name, Data: eventData(hint)})
+	})
+}
+
+// Whether the player passed all checkpoints and reached the goal.
+func (g *Game) HasFinished(player *Player) (finished bool) {
+	g.Do(func() {
+		finished = g.hasFinished(player.Name)
+	})
+
+	return
+}
+
+func (g *Game) hasFinished(name string) bool {
+	p := g.GetPlayer(name)
+
+	return p != nil && p.HasFinished(g.rules())
+}
+
+// Record the visit of the page by the player.
+func (g *Game) Visit(player *Player, page string) {
+	g.Do(func() {
+		g.change(GameEvent{Type: EventVisit, Player: player.Name, Page: page})
+	})
+}
+
+// Record the visit of the page as passed checkpoint if it is the
+// checkpoint the player has to pass next. Returns the checkpoint.
+func (g *Game) PassCheckpoint(player *Player, page string) (checkpoint string, ok bool) {
+	g.Do(func() {
+		if ok = g.change(GameEvent{Type: EventCheckpoint, Player: player.Name, Page: page}); ok {
+			passed := g.GetPlayer(player.Name).Checkpoints
+			checkpoint = passed[len(passed)-1]
+		}
+	})
+
+	return
+}
+
+// Outcome of a visit, see VisitPage.
+type VisitResult struct {
+	// Copy of the player after the visit
+	Player *Player
+
+	// The checkpoint passed with the visit, if any
+	Checkpoint       string
+	PassedCheckpoint bool
+
+	// The player reached the goal after passing all checkpoints.
+	// Standings and winner are only evaluated then.
+	Finished          bool
+	IsWinner          bool
+	IsTemporaryWinner bool
+	Standings         Standings
+	TeamStandings     TeamStandings
+}
+
+// Record the visit of the page by the player, pass the checkpoint and,
+// if the player reached the goal, evaluate the winner, all in one
+// command so that nothing else happens to the game in between. Fails
+// if the host ended the game.
+func (g *Game) VisitPage(name, page string) (result VisitResult, err error) {
+	g.Do(func() {
+		if g.Ended {
+			err = ErrGameEnded(g.Hash())
+			return
 		}
+
+		if g.GetPlayer(name) == nil {
+			err = ErrNoSuchPlayer(name)
+			return
+		}
+
+		g.change(GameEvent{Type: EventVisit, Player: name, Page: page})
+
+		if g.change(GameEvent{Type: EventCheckpoint, Player: name, Page: page}) {
+			passed := g.GetPlayer(name).Checkpoints
+			result.Checkpoint = passed[len(passed)-1]
+			result.PassedCheckpoint = true
+		}
+
+		p := g.GetPlayer(name)
+
+		if p.HasFinished(g.rules()) {
+			result.Finished = true
+			result.IsWinner, result.IsTemporaryWinner = g.evaluateWinner(p)
+
+			if result.IsWinner || result.IsTemporaryWinner {
+				g.setWinner(p)
+			}
+
+			result.Standings = g.standingsAt(time.Now())
+			result.TeamStandings = g.teamStandings()
+		}
+
+		copied := *p
+		result.Player = &copied
+	})
+
+	return
+}
+
+// Compute the current standings of the teams. Nil if the game has no teams.
+func (g *Game) TeamStandings() (standings TeamStandings) {
+	g.Do(func() {
+		standings = g.teamStandings()
+	})
+
+	return
+}
+
+func (g *Game) teamStandings() TeamStandings {
+	if !g.HasTeams() {
+		return nil
 	}
-	return false
+
+	return ComputeTeamStandings(g.standingsAt(time.Now()), g.Teams, g.TeamScoring)
 }
 
-func (g *Game) SortedPlayers() []Player {
-	// FIXME race when Player (through GetPlayer()) is modified while sorting.
-	g.playerLock.Lock()
-	defer g.playerLock.Unlock()
+// Whether a game is still running.
+type GameState string
+
+const (
+	GameRunning GameState = "running"
+	GameOver    GameState = "over"
+)
+
+func (g *Game) State() (state GameState) {
+	g.Do(func() {
+		state = g.state()
+	})
 
-	sort.Sort(SortablePlayers(g.Players))
+	return
+}
 
-	return g.Players
+func (g *Game) state() GameState {
+	if g.isOver() {
+		return GameOver
+	}
+	return GameRunning
 }
 
-func (g *Game) setWinner(player *Player) {
-	g.winnerLock.Lock()
-	defer g.winnerLock.Unlock()
+// Whether nobody can win the game anymore. In team races this is the
+// case when no other team can beat the leading team.
+func (g *Game) IsOver() (over bool) {
+	g.Do(func() {
+		over = g.isOver()
+	})
 
-	g.Winner = player.Name
-	g.WinnerPath = player.Path
+	return
+}
+
+func (g *Game) isOver() bool {
+	return g.isOverAt(time.Now())
+}
 
-	player.LeftGame = true
+func (g *Game) isOverAt(now time.Time) bool {
+	if g.Ended {
+		return true
+	}
+
+	standings := g.standingsAt(now)
+
+	if g.HasTeams() {
+		return ComputeTeamStandings(standings, g.Teams, g.TeamScoring).IsOver()
+	}
 
-	g.save()
+	return standings.IsOver()
+}
+
+// When the running game will be over because the players still racing
+// run out of time, unless it is changed before. Zero if the game is over
+// already or has no time limit.
+func (g *Game) overAt(now time.Time) time.Time {
+	if g.TimeLimit == 0 || g.isOverAt(now) {
+		return time.Time{}
+	}
+
+	rules := g.rules()
+
+	var over time.Time
+
+	// Players time out right after their deadline, see playerStatus.
+	// The earliest deadline after which the game is over wins.
+	for i := range g.Players {
+		p := &g.Players[i]
+
+		if playerStatus(p, rules, now) != StatusRacing || p.JoinedAt.IsZero() {
+			continue
+		}
+
+		at := p.JoinedAt.Add(g.TimeLimit + time.Nanosecond)
+
+		if (over.IsZero() || at.Before(over)) && g.isOverAt(at) {
+			over = at
+		}
+	}
+
+	return over
 }
 
 func (g *Game) evaluateWinner(player *Player) (isWinner, isTempWinner bool) {
-	g.winnerLock.RLock()
-	defer g.winnerLock.RUnlock()
+	standings := g.standingsAt(time.Now())
+
+	// In team races the player wins with his team. Only players that
+	// reached the goal are considered so that the winner has a path.
+	if g.HasTeams() {
+		teamStandings := ComputeTeamStandings(standings, g.Teams, g.TeamScoring)
 
-	// The player is not anywhere near the goal, he can't be winner.
-	if len(player.Path) == 0 || player.Path[len(player.Path)-1] != g.Goal {
-		return false, false
+		isTempWinner = g.hasFinished(player.Name) && teamStandings.IsLeader(player.Team)
+		isWinner = isTempWinner && teamStandings.IsOver()
+
+		return
 	}
 
 	// The player is the temporary winner when the goal has been reached
-	// (checked before) and
-	//
-	// - the player is the winner
-	// - or there is no winner yet
-	// - or the player has a lower path than the current winner
-	isTempWinner = g.Winner == player.Name || len(g.WinnerPath) == 0 || len(g.WinnerPath) > len(player.Path)
+	// and there is no other player with a better result.
+	isTempWinner = standings.IsLeader(player.Name)
 
 	// The player is the actual winner if he is a temporary winner and
 	// there is no active player with a shorter path playing anymore
 	// that can perform better than this player.
-	isWinner = isTempWinner
-
-	for _, p := range g.Players {
-		if p.Name != player.Name && len(p.Path) < len(player.Path) && !p.LeftGame {
-			isWinner = false
-			break
-		}
-	}
+	isWinner = isTempWinner && standings.IsOver()
 
 	return
 }
@@ -170,43 +556,162 @@ func (g *Game) evaluateWinner(player *Player) (isWinner, isTempWinner bool) {
 // tempWinner means that the player is the current winner but can be
 // defeated by another player with a shorter path. The player is a
 // winner if nobody can achieve (given up) or has a shorter path.
+//
+// The winner of the game is updated accordingly. To inspect the state
+// of the game without modifying it use Standings().
 func (g *Game) EvaluateWinner(player *Player) (isWinner, isTempWinner bool) {
-	isWinner, isTempWinner = g.evaluateWinner(player)
+	g.Do(func() {
+		p := g.GetPlayer(player.Name)
 
-	if isTempWinner || isWinner {
-		g.setWinner(player)
-	}
+		isWinner, isTempWinner = g.evaluateWinner(p)
+
+		if isTempWinner || isWinner {
+			g.setWinner(p)
+		}
+	})
 
 	return
 }
 
-// nil if no player has won yet.
-func (g *Game) GetWinner() *Player {
-	g.winnerLock.RLock()
-	defer g.winnerLock.RUnlock()
+// A copy of the winner, nil if no player has won yet.
+func (g *Game) GetWinner() (winner *Player) {
+	g.Do(func() {
+		if p := g.GetPlayer(g.Winner); len(g.Winner) > 0 && p != nil {
+			copied := *p
+			winner = &copied
+		}
+	})
 
-	if len(g.Winner) == 0 {
-		return nil
-	}
+	return
+}
+
+// Whether the player is the host of the game. Only the host may
+// moderate the game.
+func (g *Game) IsHost(name string) (host bool) {
+	g.Do(func() {
+		host = g.isHost(name)
+	})
+
+	return
+}
+
+func (g *Game) isHost(name string) bool {
+	return len(name) > 0 && g.Host == name
+}
 
-	return g.GetPlayer(g.Winner)
+// Remove the player from the race. The player stays in the standings
+// but can't visit pages anymore. The host can't kick himself.
+func (g *Game) Kick(name string) (err error) {
+	g.Do(func() {
+		player := g.GetPlayer(name)
+
+		if player == nil || player.Kicked {
+			err = ErrNoSuchPlayer(name)
+		} else if g.isHost(name) {
+			err = ErrKickHost()
+		} else {
+			g.change(GameEvent{Type: EventKick, Player: name})
+		}
+	})
+
+	return
+}
+
+// Make the player with the given name the new host of the game.
+func (g *Game) TransferHost(name string) (err error) {
+	g.Do(func() {
+		player := g.GetPlayer(name)
+
+		if player == nil || player.Kicked {
+			err = ErrNoSuchPlayer(name)
+		} else {
+			g.change(GameEvent{Type: EventHost, Player: player.Name})
+		}
+	})
+
+	return
+}
+
+// Lock or unlock the game for new players.
+func (g *Game) SetLocked(locked bool) {
+	g.Do(func() {
+		g.change(GameEvent{Type: EventLock, Data: eventData(locked)})
+	})
+}
+
+// End the game early. The current leader, if any, is the winner and
+// everybody else still racing is out of the race.
+func (g *Game) End() {
+	g.Do(func() {
+		g.change(GameEvent{Type: EventEnd})
+
+		if leader := g.standingsAt(time.Now()).Leader(); leader != nil {
+			if player := g.GetPlayer(leader.Name); player != nil {
+				g.setWinner(player)
+			}
+		}
+	})
 }
 
 // Check whether the player can join this game or not.
 // Returns an error if he can't explaining the reason.
-func (game *Game) CanJoin(playerName string) error {
+func (game *Game) CanJoin(playerName string, credentials JoinCredentials) (err error) {
+	game.Do(func() {
+		err = game.canJoin(playerName, credentials)
+	})
+
+	return
+}
+
+// Add the player to the given team if the player can join, see CanJoin
+// and AddPlayerToTeam. Checking and joining are one command so that no
+// other player can join in between.
+func (game *Game) Join(playerName, team string, credentials JoinCredentials) (err error) {
+	game.Do(func() {
+		if err = game.canJoin(playerName, credentials); err == nil {
+			game.change(GameEvent{Type: EventJoin, Player: playerName, Data: eventData(team)})
+		}
+	})
+
+	return
+}
+
+func (game *Game) canJoin(playerName string, credentials JoinCredentials) error {
+
+	// Check if the player was invited to a private game
+	if err := game.checkCredentials(credentials); err != nil {
+		return err
+	}
+
+	// Check if player name is not taken and does not look like a
+	// name that is taken.
+	racing := 0
+
+	for _, p := range game.Players {
+		if p.Name == playerName {
+			return ErrNameTaken(playerName)
+		}
+
+		if confusableNames(p.Name, playerName) {
+			return ErrNameConfusable(playerName, p.Name)
+		}
+
+		if !p.Kicked {
+			racing++
+		}
+	}
+
+	if game.Locked {
+		return ErrGameLocked()
+	}
 
-	// Check if player name is not taken
-	if game.HasPlayer(playerName) {
-		// TODO: User friendly error message, maybe redirect the
-		// player back to the login form and display a hint.
-		return fmt.Errorf("Player name already taken.")
+	if game.MaxPlayers > 0 && racing >= game.MaxPlayers {
+		return ErrGameFull(game.MaxPlayers)
 	}
 
 	// Don't allow join when there's already a winner
 	if len(game.Winner) > 0 {
-		// TODO: user friendly error message. See TODO above.
-		return fmt.Errorf("Game is locked as it has already a winner.")
+		return ErrGameHasWinner()
 	}
 
 	return nil
@@ -3,13 +3,21 @@ package main
 import (
 	"crypto"
 	_ "crypto/sha1"
+	"errors"
 	"fmt"
+	"log"
+	"sync"
 	"time"
 
 	"github.com/githubnemo/wikirace-serv/wikis"
 )
 
-var gameHasher = crypto.SHA1.New()
+var (
+	gameHasher = crypto.SHA1.New()
+
+	// Lock for gameHasher, games are created concurrently.
+	gameHasherLock sync.Mutex
+)
 
 func init() {
 	// Initialize the gameHasher with the current date so that
@@ -19,16 +27,72 @@ func init() {
 }
 
 type GameStore struct {
-	*Store
+	GameRepository
+
+	// Finished and abandoned games are moved here, see ExpiryPolicy.
+	archive GameRepository
+
+	activeGames   map[string]*Game
+	activeMatches map[string]*Match
+	activeDailies map[string]*DailyChallenge
+
+	// Time each active game, match or daily challenge was last
+	// requested, keyed like the store.
+	lastAccess map[string]time.Time
+
+	// Games being loaded or archived, see claim. The channel is closed
+	// once the game is done with.
+	claims map[string]chan struct{}
+
+	// Lock for activeGames, activeMatches, activeDailies, lastAccess,
+	// claims and refusing
+	activeLock sync.Mutex
+
+	// Held while the daily challenge of the day is created.
+	dailyLock sync.Mutex
 
-	activeGames map[string]*Game
+	// Held for a game while events are appended to its journal.
+	journalLocks keyLocks
+
+	// Writes changed games in the background if set, see WriteBehind.
+	persister *Persister
+
+	// Set once no new games are accepted, see RefuseNewGames.
+	refusing bool
+
+	// Closed by StopExpiry
+	expiryStop chan struct{}
+
+	// Held while RunExpiry is running
+	expiryRunning sync.Mutex
+}
+
+// Returned by PutGame once the store refuses new games.
+var errShuttingDown = errors.New("The server is shutting down.")
+
+func NewGameStore(repository GameRepository, archive GameRepository) *GameStore {
+	return &GameStore{
+		GameRepository: repository,
+		archive:        archive,
+		activeGames:    make(map[string]*Game),
+		claims:         make(map[string]chan struct{}),
+		activeMatches:  make(map[string]*Match),
+		activeDailies:  make(map[string]*DailyChallenge),
+		lastAccess:     make(map[string]time.Time),
+		expiryStop:     make(chan struct{}),
+	}
 }
 
-func NewGameStore(s *Store) *GameStore {
-	return &GameStore{s, make(map[string]*Game)}
+// Matches share the store with the games, their keys are prefixed
+// so that they can't be confused with game hashes.
+func matchKey(hash string) string {
+	return "match-" + hash
 }
 
 func (g *GameStore) NewGameHash(playerName string) (shash string) {
+	gameHasherLock.Lock()
+	defer gameHasherLock.Unlock()
+
 	gameHasher.Write([]byte(playerName))
 
 	for i := 0; ; i++ {
@@ -45,42 +109,548 @@ func (g *GameStore) NewGameHash(playerName string) (shash string) {
 	return shash
 }
 
-func (g *GameStore) gameSaveHandler(game *Game) {
+// Persist the game and remember when it was changed. Starts the
+// journal of the game, changes after the first put are journaled. The
+// game becomes the active instance of the game with its hash.
+func (g *GameStore) PutGame(game *Game) (err error) {
+	g.activeLock.Lock()
+	refusing := g.refusing
+	g.activeLock.Unlock()
+
+	if refusing {
+		return errShuttingDown
+	}
+
+	game.Do(func() {
+		game.startJournal()
+
+		err = g.writeGame(game)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	g.activeLock.Lock()
+	defer g.activeLock.Unlock()
+
+	if _, ok := g.activeGames[game.Hash()]; !ok {
+		g.activeGames[game.Hash()] = game
+		g.lastAccess[game.Hash()] = time.Now()
+
+		game.own()
+	}
+
+	return nil
+}
+
+// Let PutGame fail from now on, games that were put before are still
+// written. Used to shut down.
+func (g *GameStore) RefuseNewGames() {
+	g.activeLock.Lock()
+	defer g.activeLock.Unlock()
+
+	g.refusing = true
+}
+
+// Write the snapshot of the game. Has to be run as command of the game,
+// see Game.Do.
+func (g *GameStore) writeGame(game *Game) error {
+	game.UpdatedAt = time.Now()
+
 	// Note that there is no lock needed here as PutMarshal works atomically.
-	err := gameStore.PutMarshal(game.Hash(), game)
+	return g.PutMarshal(game.Hash(), game)
+}
+
+// The journal of a game is stored under a single key next to the game,
+// see Journal.
+func journalKey(hash string) string {
+	return "journal-" + hash
+}
+
+// Journals are started over once they are longer than this, see
+// compactJournal.
+const maxJournalLength = 100
+
+func (g *GameStore) writeEvents(game *Game, events []GameEvent) error {
+	return g.appendJournal(game.Hash(), events)
+}
+
+// Append the events to the journal of the game. Journals that grew too
+// long are compacted.
+func (g *GameStore) appendJournal(hash string, events []GameEvent) error {
+	g.journalLocks.Lock(hash)
+	defer g.journalLocks.Unlock(hash)
+
+	journal, err := readJournal(g.GameRepository, hash, 0)
+
+	if err != nil {
+		return err
+	}
+
+	journal = append(journal, events...)
+
+	if len(journal) > maxJournalLength {
+		if journal, err = compactJournal(journal); err != nil {
+			return err
+		}
+	}
+
+	return g.PutMarshal(journalKey(hash), journal)
+}
+
+// Start the journal over with the game as of its last event, which
+// takes the place of the creation of the game. Earlier events are
+// dropped.
+func compactJournal(journal []GameEvent) ([]GameEvent, error) {
+	game, err := ReplayGame(journal)
 
 	if err != nil {
-		// TODO: proper error handling
-		panic(err)
+		return nil, err
+	}
+
+	last := journal[len(journal)-1]
+
+	return []GameEvent{{Seq: last.Seq, Time: last.Time, Type: EventCreated, Data: eventData(game)}}, nil
+}
+
+func (g *GameStore) journalHandler(game *Game, e GameEvent) {
+	if g.persister != nil {
+		g.persister.AppendEvent(game, e)
+		return
+	}
+
+	if err := g.writeEvents(game, []GameEvent{e}); err != nil {
+		log.Printf("Error journaling event %d of game %s: %s\n", e.Seq, game.Hash(), err)
+	}
+}
+
+// The journaled events of the game after the given sequence number,
+// in order. The complete journal starts after zero. Compacted journals
+// start with the game as of the compaction, see compactJournal. Journals
+// of archived games are read from the archive. Events written behind are
+// only found after the next flush, see WriteBehind.
+func (g *GameStore) Journal(hash string, after int) ([]GameEvent, error) {
+	if g.IsArchived(hash) {
+		return readJournal(g.archive, hash, after)
+	}
+
+	return readJournal(g.GameRepository, hash, after)
+}
+
+// Events after the given sequence number. If the journal was compacted
+// since, it is returned from the compaction on.
+func readJournal(repository GameRepository, hash string, after int) ([]GameEvent, error) {
+	if !repository.Has(journalKey(hash)) {
+		return nil, nil
+	}
+
+	var journal []GameEvent
+
+	if err := repository.GetMarshal(journalKey(hash), &journal); err != nil {
+		return nil, err
+	}
+
+	for i, e := range journal {
+		if e.Seq > after {
+			return journal[i:], nil
+		}
+	}
+
+	return nil, nil
+}
+
+func writeJournal(repository GameRepository, hash string, journal []GameEvent) error {
+	if len(journal) == 0 {
+		return eraseJournal(repository, hash)
+	}
+
+	return repository.PutMarshal(journalKey(hash), journal)
+}
+
+func eraseJournal(repository GameRepository, hash string) error {
+	if !repository.Has(journalKey(hash)) {
+		return nil
+	}
+
+	return repository.Erase(journalKey(hash))
+}
+
+// Load the snapshot of the game and apply the changes that were
+// journaled but are not in the snapshot yet.
+func (g *GameStore) loadGame(hash string) (*Game, error) {
+	// Create empty game, values don't matter as they'll be
+	// overwritten by GetMarshal. What matters is the initialization
+	// of private members and start of go routines and such.
+	game := NewGame("", nil, nil)
+
+	if err := g.GetMarshal(hash, game); err != nil {
+		return nil, err
+	}
+
+	// Only the game store knows the real hash, so we set it here.
+	game.hash = hash
+
+	events, err := readJournal(g.GameRepository, hash, game.JournalSeq)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := game.Replay(events); err != nil {
+		return nil, err
+	}
+
+	return game, nil
+}
+
+// Write changed games, their journal, matches and daily challenges in
+// the background, at most maxDelay after they were changed. The
+// returned persister has to be run by the caller and stopped before
+// exiting to write the remaining changes.
+func (g *GameStore) WriteBehind(maxDelay time.Duration) *Persister {
+	g.persister = NewPersister(func(game *Game) (err error) {
+		game.Do(func() {
+			err = g.writeGame(game)
+		})
+		return
+	}, maxDelay)
+
+	g.persister.PutEvents = g.writeEvents
+	g.persister.PutValue = g.PutMarshal
+
+	return g.persister
+}
+
+func (g *GameStore) isDirty(hash string) bool {
+	return g.persister != nil && g.persister.IsDirty(hash)
+}
+
+func (g *GameStore) gameSaveHandler(game *Game) {
+	if g.persister != nil {
+		g.persister.MarkDirty(game)
+		return
+	}
+
+	if err := g.writeGame(game); err != nil {
+		log.Printf("Error writing game %s: %s\n", game.Hash(), err)
 	}
 }
 
 func (g *GameStore) NewGame(hostingPlayerName string, wiki *wikis.Wiki) *Game {
-	return NewGame(hostingPlayerName, wiki, g.gameSaveHandler)
+	game := NewGame(hostingPlayerName, wiki, g.gameSaveHandler)
+	game.journalHandler = g.journalHandler
+
+	return game
+}
+
+// Claim the game with the hash to load or archive it. Has to be called
+// with activeLock held. If somebody else claimed it already, the
+// returned channel is closed once they are done and ok is false.
+// Claims are given up with unclaim.
+func (g *GameStore) claim(hash string) (done chan struct{}, ok bool) {
+	if done, claimed := g.claims[hash]; claimed {
+		return done, false
+	}
+
+	done = make(chan struct{})
+	g.claims[hash] = done
+
+	return done, true
+}
+
+func (g *GameStore) unclaim(hash string) {
+	g.activeLock.Lock()
+	defer g.activeLock.Unlock()
+
+	close(g.claims[hash])
+	delete(g.claims, hash)
 }
 
 // Only one (pooled) instance of a game instance is returned.
 // The key has to be present.
+//
+// The game is loaded without holding up other games. Requests for the
+// same game wait for the first one to load it, or for the game to be
+// archived.
 func (g *GameStore) GetGameByHash(hash string) (*Game, error) {
-	if game, ok := g.activeGames[hash]; ok {
-		return game, nil
+	for {
+		g.activeLock.Lock()
+
+		g.lastAccess[hash] = time.Now()
+
+		if game, ok := g.activeGames[hash]; ok {
+			g.activeLock.Unlock()
+			return game, nil
+		}
+
+		done, ok := g.claim(hash)
+
+		g.activeLock.Unlock()
+
+		if ok {
+			break
+		}
+
+		<-done
 	}
 
-	// Create empty game, values don't matter as they'll be
-	// overwritten by GetMarshal. What matters is the initialization
-	// of private members and start of go routines and such.
-	game := g.NewGame("", nil)
+	defer g.unclaim(hash)
 
-	err := g.GetMarshal(hash, game)
+	// The handlers are set afterwards, otherwise the empty game is saved.
+	game, err := g.loadGame(hash)
 
 	if err != nil {
 		return nil, err
 	}
 
-	// Only the game store knows the real hash, so we set it here.
-	game.hash = hash
+	game.saveHandler = g.gameSaveHandler
+	game.journalHandler = g.journalHandler
+
+	// Games stored before there were journals.
+	game.startJournal()
+
+	game.own()
+
+	g.activeLock.Lock()
+	defer g.activeLock.Unlock()
 
 	g.activeGames[hash] = game
 
 	return game, nil
 }
+
+// Write the value now or, with a persister, in the background. Errors
+// are reported, not returned, like those of games.
+func (g *GameStore) saveValue(key string, v interface{}) {
+	if g.persister != nil {
+		g.persister.MarkValueDirty(key, v)
+		return
+	}
+
+	if err := g.PutMarshal(key, v); err != nil {
+		log.Printf("Error writing %s: %s\n", key, err)
+	}
+}
+
+func (g *GameStore) matchSaveHandler(match *Match) {
+	g.saveValue(matchKey(match.Hash()), match)
+}
+
+// Create a new match. The first round has to be added by the caller.
+func (g *GameStore) NewMatch(hostingPlayerName string, wiki *wikis.Wiki, rounds int) *Match {
+	match := NewMatch(hostingPlayerName, wiki, rounds, g.matchSaveHandler)
+
+	g.activeLock.Lock()
+	defer g.activeLock.Unlock()
+
+	g.activeMatches[match.Hash()] = match
+	g.lastAccess[matchKey(match.Hash())] = time.Now()
+
+	return match
+}
+
+// Only one (pooled) instance of a match is returned.
+// The key has to be present.
+func (g *GameStore) GetMatchByHash(hash string) (*Match, error) {
+	g.activeLock.Lock()
+	defer g.activeLock.Unlock()
+
+	g.lastAccess[matchKey(hash)] = time.Now()
+
+	if match, ok := g.activeMatches[hash]; ok {
+		return match, nil
+	}
+
+	match := NewMatch("", nil, 0, g.matchSaveHandler)
+
+	err := g.GetMarshal(matchKey(hash), match)
+
+	if err != nil {
+		return nil, err
+	}
+
+	match.hash = hash
+
+	g.activeMatches[hash] = match
+
+	return match, nil
+}
+
+// Create the game for the next round of the match with a fresh start
+// and goal. All players of the match are added to the game.
+func (g *GameStore) NewRound(match *Match) (*Game, error) {
+	start, goal, err := match.Wiki.DetermineStartAndGoal()
+
+	if err != nil {
+		return nil, ErrStartAndGoal(err)
+	}
+
+	game := g.NewGame(match.Host, match.Wiki)
+
+	game.Start = start
+	game.Goal = goal
+	game.Match = match.Hash()
+	game.HintPenalty = DefaultHintPenalty
+
+	for _, name := range match.PlayerNames() {
+		if !game.HasPlayer(name) {
+			game.AddPlayer(name)
+		}
+	}
+
+	if err := g.PutGame(game); err != nil {
+		return nil, ErrGameMarshal(err)
+	}
+
+	match.AddRound(game)
+
+	return game, nil
+}
+
+// Create a rematch of the given game on the same wiki with a fresh start
+// and goal, hosted by the given player and joined by the given players.
+// If there already is a rematch of the game, that one is returned instead.
+// Only the call that created the rematch returns created, so that the
+// players are told about it exactly once.
+func (g *GameStore) NewRematch(game *Game, hostingPlayerName string, players []string) (rematch *Game, created bool, err error) {
+	game.owner.rematchLock.Lock()
+	defer game.owner.rematchLock.Unlock()
+
+	settings := game.Snapshot()
+
+	if hash := settings.Rematch; len(hash) > 0 {
+		rematch, err = g.GetGameByHash(hash)
+		return rematch, false, err
+	}
+
+	start, goal, err := settings.Wiki.DetermineStartAndGoal()
+
+	if err != nil {
+		return nil, false, ErrStartAndGoal(err)
+	}
+
+	rematch = g.NewGame(hostingPlayerName, settings.Wiki)
+
+	rematch.Start = start
+	rematch.Goal = goal
+	rematch.TimeLimit = settings.TimeLimit
+	rematch.HintPenalty = settings.HintPenalty
+	rematch.Forbidden = settings.Forbidden
+	rematch.Teams = settings.Teams
+	rematch.TeamScoring = settings.TeamScoring
+	rematch.MaxPlayers = settings.MaxPlayers
+	rematch.Private = settings.Private
+	rematch.PasswordSalt = settings.PasswordSalt
+	rematch.PasswordHash = settings.PasswordHash
+	rematch.InviteNonce = randomString(16)
+
+	for _, name := range players {
+		if !rematch.HasPlayer(name) {
+			rematch.AddPlayer(name)
+		}
+	}
+
+	if err := g.PutGame(rematch); err != nil {
+		return nil, false, ErrGameMarshal(err)
+	}
+
+	game.Do(func() {
+		game.change(GameEvent{Type: EventRematch, Data: eventData(rematch.Hash())})
+	})
+
+	return rematch, true, nil
+}
+
+func (g *GameStore) dailySaveHandler(daily *DailyChallenge) {
+	g.saveValue(daily.Key(), daily)
+}
+
+// The daily challenge of the wiki for the given day. The challenge is
+// created on first request of the day, with start and goal seeded by
+// the wiki and the day.
+func (g *GameStore) GetDaily(wiki *wikis.Wiki, day string) (*DailyChallenge, error) {
+	key := dailyKey(wiki, day)
+
+	g.dailyLock.Lock()
+	defer g.dailyLock.Unlock()
+
+	g.activeLock.Lock()
+	daily, ok := g.activeDailies[key]
+	g.lastAccess[key] = time.Now()
+	g.activeLock.Unlock()
+
+	if ok {
+		return daily, nil
+	}
+
+	daily = NewDailyChallenge(wiki, day, g.dailySaveHandler)
+
+	if g.Has(key) {
+		if err := g.GetMarshal(key, daily); err != nil {
+			return nil, err
+		}
+	} else {
+		start, goal, err := wiki.SeededStartAndGoal(dailySeed(wiki, day))
+
+		if err != nil {
+			return nil, ErrStartAndGoal(err)
+		}
+
+		daily.Start = start
+		daily.Goal = goal
+
+		if err := g.PutMarshal(key, daily); err != nil {
+			return nil, ErrGameMarshal(err)
+		}
+	}
+
+	g.activeLock.Lock()
+	g.activeDailies[key] = daily
+	g.activeLock.Unlock()
+
+	return daily, nil
+}
+
+// The daily challenge stored under the given key.
+func (g *GameStore) GetDailyByKey(key string) (*DailyChallenge, error) {
+	g.activeLock.Lock()
+	daily, ok := g.activeDailies[key]
+	g.activeLock.Unlock()
+
+	if ok {
+		return daily, nil
+	}
+
+	daily = NewDailyChallenge(nil, "", g.dailySaveHandler)
+
+	if err := g.GetMarshal(key, daily); err != nil {
+		return nil, err
+	}
+
+	return g.GetDaily(daily.Wiki, daily.Day)
+}
+
+// Create a solo game of the daily challenge for the player. Fails if
+// the player started the challenge before.
+func (g *GameStore) NewDailyGame(daily *DailyChallenge, playerName string) (*Game, error) {
+	game := g.NewGame(playerName, daily.Wiki)
+
+	game.Start = daily.Start
+	game.Goal = daily.Goal
+	game.Daily = daily.Key()
+	game.HintPenalty = DefaultHintPenalty
+
+	// Recorded before the game exists so that a second attempt can't
+	// be started in between.
+	if !daily.addAttempt(playerName, game.Hash()) {
+		return nil, ErrDailyPlayed(playerName)
+	}
+
+	if err := g.PutGame(game); err != nil {
+		daily.removeAttempt(playerName)
+		return nil, ErrGameMarshal(err)
+	}
+
+	return game, nil
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"testing"
+	"time"
+
 	"github.com/githubnemo/wikirace-serv/wikis"
 )
 
@@ -125,3 +127,258 @@ func TestTemporaryWinnerOvertakingSimple(t *testing.T) {
 		t.Errorf("player2: winner: %t, temporary: %t, expected both true", isWinner, isTempWinner)
 	}
 }
+
+func TestStandingsDoNotModifyGame(t *testing.T) {
+	game := simpleTwoPlayerGame()
+
+	game.GetPlayer("player 1").Visited("other page")
+	game.GetPlayer("player 2").Visited(game.Goal)
+
+	standings := game.Standings()
+
+	if !standings.IsWinner("player 2") {
+		t.Errorf("player 2 should be the winner, standings: %#v", standings)
+	}
+
+	if len(game.Winner) != 0 {
+		t.Errorf("computing standings set the winner to %s", game.Winner)
+	}
+}
+
+func TestStandingsTies(t *testing.T) {
+	joined := time.Date(2014, 1, 1, 12, 0, 0, 0, time.UTC)
+	finished := joined.Add(time.Minute)
+
+	players := []Player{
+		{Name: "a", Path: []string{"start", "x", "goal"}, JoinedAt: joined, LastVisitAt: finished},
+		{Name: "b", Path: []string{"start", "y", "goal"}, JoinedAt: joined, LastVisitAt: finished},
+		{Name: "c", Path: []string{"start", "goal"}, JoinedAt: joined, LastVisitAt: finished.Add(time.Hour)},
+		{Name: "d", Path: []string{"start"}, JoinedAt: joined, LeftGame: true},
+		{Name: "e", Path: []string{"start", "x"}, JoinedAt: joined},
+	}
+
+	standings := ComputeStandings(players, RaceRules{Goal: "goal"}, finished)
+
+	expected := []struct {
+		Name   string
+		Rank   int
+		Status PlayerStatus
+	}{
+		{"c", 1, StatusFinished},
+		{"a", 2, StatusFinished},
+		{"b", 2, StatusFinished},
+		{"e", 4, StatusRacing},
+		{"d", 5, StatusGaveUp},
+	}
+
+	for i, e := range expected {
+		s := standings[i]
+
+		if s.Name != e.Name || s.Rank != e.Rank || s.Status != e.Status {
+			t.Errorf("standing %d: got (%s, %d, %s), expected (%s, %d, %s)",
+				i, s.Name, s.Rank, s.Status, e.Name, e.Rank, e.Status)
+		}
+	}
+
+	if !standings.IsOver() {
+		t.Errorf("nobody can beat c anymore, the game should be over")
+	}
+}
+
+func TestStandingsTimeLimit(t *testing.T) {
+	joined := time.Date(2014, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	players := []Player{
+		{Name: "a", Path: []string{"start", "x", "y", "goal"}, JoinedAt: joined, LastVisitAt: joined.Add(time.Minute)},
+		{Name: "b", Path: []string{"start"}, JoinedAt: joined},
+	}
+
+	standings := ComputeStandings(players, RaceRules{Goal: "goal", TimeLimit: 5 * time.Minute}, joined.Add(2*time.Minute))
+
+	if standings.IsOver() {
+		t.Errorf("b is still within the time limit, the game should not be over")
+	}
+
+	standings = ComputeStandings(players, RaceRules{Goal: "goal", TimeLimit: 5 * time.Minute}, joined.Add(10*time.Minute))
+
+	if s := standings.Get("b"); s.Status != StatusTimedOut {
+		t.Errorf("b should be timed out, got %s", s.Status)
+	}
+
+	if !standings.IsWinner("a") {
+		t.Errorf("a should be the winner after b timed out")
+	}
+}
+
+// Nobody reached the goal but nobody can anymore either.
+func TestGameWithoutFinisherIsOver(t *testing.T) {
+	joined := time.Date(2014, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	players := []Player{
+		{Name: "a", Path: []string{"start", "x"}, JoinedAt: joined, Team: "red"},
+		{Name: "b", Path: []string{"start"}, JoinedAt: joined, Team: "blue"},
+		{Name: "c", Path: []string{"start"}, JoinedAt: joined, Kicked: true, Team: "blue"},
+	}
+
+	rules := RaceRules{Goal: "goal", TimeLimit: 5 * time.Minute}
+
+	if ComputeStandings(players, rules, joined.Add(2*time.Minute)).IsOver() {
+		t.Errorf("a and b are still racing, the game should not be over")
+	}
+
+	standings := ComputeStandings(players, rules, joined.Add(10*time.Minute))
+
+	if !standings.IsOver() || standings.Leader() != nil {
+		t.Errorf("everybody is out of time, the game should be over without a winner: %#v", standings)
+	}
+
+	teamStandings := ComputeTeamStandings(standings, []string{"red", "blue"}, ScoreBestMember)
+
+	if !teamStandings.IsOver() || teamStandings.Leader() != nil {
+		t.Errorf("no team can finish, the team race should be over: %#v", teamStandings)
+	}
+}
+
+func TestTeamRaceEndsWhenNoOtherTeamCanWin(t *testing.T) {
+	game := NewGame("a1", &wikis.Wiki{}, nil)
+	game.Start = "start"
+	game.Goal = "goal"
+	game.SetTeams([]string{"red", "blue"}, ScoreBestMember)
+
+	game.AddPlayerToTeam("b1", "blue")
+	game.AddPlayerToTeam("a2", "red")
+	game.AddPlayerToTeam("b2", "blue")
+
+	for _, name := range []string{"a1", "a2", "b1", "b2"} {
+		game.GetPlayer(name).Visited(game.Start)
+	}
+
+	if team := game.GetPlayer("a1").Team; team != "red" {
+		t.Fatalf("host should have been assigned to red, got %q", team)
+	}
+
+	// b1 finishes with two visits but a2 of red can still tie
+	// that with his single visit, so blue only leads for now.
+	b1 := game.GetPlayer("b1")
+	b1.Visited(game.Goal)
+
+	isWinner, isTempWinner := game.EvaluateWinner(b1)
+	if isWinner || !isTempWinner {
+		t.Errorf("b1: winner: %t, temporary: %t, expected (false, true)", isWinner, isTempWinner)
+	}
+
+	// Nobody of red can beat blue anymore, a1 and a2 are too far away.
+	game.GetPlayer("a1").Visited("x")
+	game.GetPlayer("a2").Visited("y")
+
+	isWinner, _ = game.EvaluateWinner(b1)
+	if !isWinner {
+		t.Errorf("b1 should have won with team blue, team standings: %#v", game.TeamStandings())
+	}
+
+	// b2 is still racing but is in the winning team, this must not
+	// prevent the game from being over.
+	if !game.IsOver() {
+		t.Errorf("game should be over")
+	}
+}
+
+func TestGoalOnlyCountsAfterCheckpoints(t *testing.T) {
+	game := simpleTwoPlayerGame()
+	game.Checkpoints = []string{"first", "second"}
+	game.CheckpointsInOrder = true
+
+	player := game.GetPlayer("player 1")
+
+	// Second checkpoint before the first does not count in ordered mode.
+	player.Visited("second")
+	if _, ok := game.PassCheckpoint(player, "second"); ok {
+		t.Errorf("second checkpoint must not count before the first")
+	}
+
+	player.Visited(game.Goal)
+	if game.HasFinished(player) {
+		t.Errorf("goal must not count without the checkpoints")
+	}
+
+	for _, page := range []string{"first", "second"} {
+		player.Visited(page)
+		if _, ok := game.PassCheckpoint(player, page); !ok {
+			t.Errorf("%s should have been passed", page)
+		}
+	}
+
+	player.Visited(game.Goal)
+	if !game.HasFinished(player) {
+		t.Errorf("player passed all checkpoints and should be finished")
+	}
+}
+
+func TestHintPenaltyAffectsRanking(t *testing.T) {
+	game := simpleTwoPlayerGame()
+	game.HintPenalty = 2
+
+	player1 := game.GetPlayer("player 1")
+	player2 := game.GetPlayer("player 2")
+
+	// player1 is one click faster but used a hint, which costs him
+	// two clicks, so player2 wins.
+	game.AddHint(player1, Hint{Kind: HintGoalCategory})
+	player1.Visited(game.Goal)
+	player2.Visited("other page")
+	player2.Visited(game.Goal)
+
+	standings := game.Standings()
+
+	if s := standings.Get("player 1"); s.Score != 4 || s.Penalty != 2 {
+		t.Errorf("player 1 should have a score of 4 with a penalty of 2, got %d and %d", s.Score, s.Penalty)
+	}
+
+	if !standings.IsWinner("player 2") {
+		t.Errorf("player 2 should be the winner, standings: %#v", standings)
+	}
+}
+
+func TestHostModeration(t *testing.T) {
+	game := simpleTwoPlayerGame()
+	game.AddPlayer("player 3")
+
+	if err := game.Kick("player 1"); err == nil {
+		t.Errorf("the host must not be able to kick himself")
+	}
+
+	if err := game.Kick("player 3"); err != nil {
+		t.Fatalf("kicking player 3 failed: %s", err)
+	}
+
+	if s := game.Standings().Get("player 3"); s.Status != StatusKicked {
+		t.Errorf("player 3 should be kicked, got %s", s.Status)
+	}
+
+	if err := game.TransferHost("player 3"); err == nil {
+		t.Errorf("kicked players can't become host")
+	}
+
+	if err := game.TransferHost("player 2"); err != nil || !game.IsHost("player 2") {
+		t.Errorf("player 2 should be the host now, err: %v", err)
+	}
+
+	game.SetLocked(true)
+
+	if err := game.CanJoin("player 4", JoinCredentials{}); err == nil {
+		t.Errorf("nobody should be able to join a locked game")
+	}
+
+	// player 1 reached the goal, player 2 is still racing but the host
+	// ends the game before he can catch up.
+	game.GetPlayer("player 1").Visited(game.Goal)
+	game.End()
+
+	if !game.IsOver() || game.Winner != "player 1" {
+		t.Errorf("game should be over with player 1 as winner, winner is %q", game.Winner)
+	}
+
+	if s := game.Standings().Get("player 2"); s.Status != StatusTimedOut {
+		t.Errorf("player 2 should be out of the race, got %s", s.Status)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/githubnemo/wikirace-serv/wikis"
+)
+
+// Kinds of hints a player can ask for.
+const (
+	// Reveals a category of the goal page.
+	HintGoalCategory = "category"
+
+	// Reveals a link on the current page that leads directly to the goal.
+	HintLink = "link"
+)
+
+// Number of clicks added to the score of a player for each hint
+// if the host did not choose otherwise.
+const DefaultHintPenalty = 2
+
+// A hint a player asked for.
+type Hint struct {
+	Kind string
+
+	// The page the player was on when asking for the hint
+	Page string
+
+	Text string
+	At   time.Time
+}
+
+// Find a hint of the given kind for the player. The hint is not
+// recorded, see Game.AddHint.
+func FindHint(game *Game, player *Player, kind string) (Hint, error) {
+	hint := Hint{Kind: kind, Page: player.LastVisited(), At: time.Now()}
+
+	var err error
+
+	switch kind {
+	case HintGoalCategory:
+		hint.Text, err = goalCategoryHint(game, player)
+	case HintLink:
+		hint.Text, err = linkHint(game, hint.Page)
+	default:
+		err = fmt.Errorf("Unknown hint kind %q.", kind)
+	}
+
+	return hint, err
+}
+
+// Reveal the next category of the goal the player does not know yet.
+// Hidden maintenance categories tell nothing about the goal.
+func goalCategoryHint(game *Game, player *Player) (string, error) {
+	categories, err := game.Wiki.PageCategories([]string{game.Goal}, false)
+
+	if err != nil {
+		return "", err
+	}
+
+	known := make(map[string]bool)
+
+	for _, h := range player.Hints {
+		if h.Kind == HintGoalCategory {
+			known[h.Text] = true
+		}
+	}
+
+	for _, c := range categories[game.Goal] {
+		text := fmt.Sprintf("The goal is in the category %s.", c)
+
+		if !known[text] {
+			return text, nil
+		}
+	}
+
+	return "There are no more categories of the goal to reveal.", nil
+}
+
+// Look for a link on the page that links to the goal directly.
+func linkHint(game *Game, page string) (string, error) {
+	links, err := game.Wiki.PageLinks(page)
+
+	if err != nil {
+		return "", err
+	}
+
+	for _, link := range links {
+		if wikis.SamePage(link, game.Goal) {
+			return "The goal is linked on this very page!", nil
+		}
+	}
+
+	backlinks, err := game.Wiki.Backlinks(game.Goal)
+
+	if err != nil {
+		return "", err
+	}
+
+	leadsToGoal := make(map[string]bool)
+
+	for _, link := range backlinks {
+		leadsToGoal[wikis.NormalizeTitle(link)] = true
+	}
+
+	for _, link := range links {
+		if !leadsToGoal[wikis.NormalizeTitle(link)] {
+			continue
+		}
+
+		if forbidden, err := game.Forbidden.IsForbidden(game.Wiki, link); err != nil || forbidden {
+			continue
+		}
+
+		return fmt.Sprintf("%s is linked on this page and links to the goal.", link), nil
+	}
+
+	return "No link on this page leads to the goal directly. Try a more general page.", nil
+}
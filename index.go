@@ -0,0 +1,351 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hashes of games by the value of an indexed field.
+type hashIndex map[string]map[string]struct{}
+
+func (idx hashIndex) add(value, hash string) {
+	if idx[value] == nil {
+		idx[value] = make(map[string]struct{})
+	}
+	idx[value][hash] = struct{}{}
+}
+
+func (idx hashIndex) remove(value, hash string) {
+	delete(idx[value], hash)
+
+	if len(idx[value]) == 0 {
+		delete(idx, value)
+	}
+}
+
+// Game hashes ordered by creation time.
+type createdEntry struct {
+	CreatedAt time.Time
+	Hash      string
+}
+
+// Keeps the keys of the wrapped repository and the queryable fields of
+// its games in memory so that lookups and queries don't have to go
+// through all stored games. The indexes are built when the repository
+// is wrapped and maintained on every put and erase. Archives are indexed
+// the same way, see ArchivedGame.
+type IndexedRepository struct {
+	GameRepository
+
+	// Held for a key while it is written or erased and its index entry
+	// updated, so that the index follows the order of the writes.
+	keyLocks keyLocks
+
+	// Lock for all indexes
+	lock sync.RWMutex
+
+	keys  map[string]struct{}
+	games map[string]GameSummary
+
+	byState   hashIndex
+	byHost    hashIndex
+	byWiki    hashIndex
+	byPlayer  hashIndex
+	byWinner  hashIndex
+	byCreated []createdEntry
+}
+
+// Wrap the repository, reading all stored games to build the indexes.
+func NewIndexedRepository(repository GameRepository) (*IndexedRepository, error) {
+	r := &IndexedRepository{
+		GameRepository: repository,
+		keys:           make(map[string]struct{}),
+		games:          make(map[string]GameSummary),
+		byState:        make(hashIndex),
+		byHost:         make(hashIndex),
+		byWiki:         make(hashIndex),
+		byPlayer:       make(hashIndex),
+		byWinner:       make(hashIndex),
+	}
+
+	keys, err := repository.Keys("")
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		r.keys[key] = struct{}{}
+
+		if !isGameKey(key) {
+			continue
+		}
+
+		_, summary, err := readStoredGame(repository, key)
+
+		if err != nil {
+			return nil, err
+		}
+
+		r.index(key, summary)
+	}
+
+	return r, nil
+}
+
+func (r *IndexedRepository) index(hash string, e GameSummary) {
+	old, known := r.games[hash]
+
+	if known {
+		r.unindex(hash, old, old.CreatedAt.Equal(e.CreatedAt))
+	}
+
+	r.games[hash] = e
+
+	r.byState.add(string(e.State), hash)
+	r.byHost.add(e.Host, hash)
+	r.byWiki.add(e.Wiki, hash)
+	r.byWinner.add(e.Winner, hash)
+
+	for _, p := range e.Players {
+		r.byPlayer.add(p, hash)
+	}
+
+	// The creation time of a game does not change, only new games need
+	// to be sorted in.
+	if !known || !old.CreatedAt.Equal(e.CreatedAt) {
+		i := r.createdIndex(e.CreatedAt, hash)
+
+		r.byCreated = append(r.byCreated, createdEntry{})
+		copy(r.byCreated[i+1:], r.byCreated[i:])
+		r.byCreated[i] = createdEntry{e.CreatedAt, hash}
+	}
+}
+
+func (r *IndexedRepository) unindex(hash string, e GameSummary, keepCreated bool) {
+	delete(r.games, hash)
+
+	r.byState.remove(string(e.State), hash)
+	r.byHost.remove(e.Host, hash)
+	r.byWiki.remove(e.Wiki, hash)
+	r.byWinner.remove(e.Winner, hash)
+
+	for _, p := range e.Players {
+		r.byPlayer.remove(p, hash)
+	}
+
+	if !keepCreated {
+		i := r.createdIndex(e.CreatedAt, hash)
+
+		if i < len(r.byCreated) && r.byCreated[i].Hash == hash {
+			r.byCreated = append(r.byCreated[:i], r.byCreated[i+1:]...)
+		}
+	}
+}
+
+// Position of the game in byCreated or where it belongs.
+func (r *IndexedRepository) createdIndex(createdAt time.Time, hash string) int {
+	return sort.Search(len(r.byCreated), func(i int) bool {
+		e := r.byCreated[i]
+		return e.CreatedAt.After(createdAt) || e.CreatedAt.Equal(createdAt) && e.Hash >= hash
+	})
+}
+
+func (r *IndexedRepository) PutMarshal(key string, v interface{}) error {
+	r.keyLocks.Lock(key)
+	defer r.keyLocks.Unlock(key)
+
+	if err := r.GameRepository.PutMarshal(key, v); err != nil {
+		return err
+	}
+
+	var entry *GameSummary
+
+	if isGameKey(key) {
+		switch value := v.(type) {
+		case *Game:
+			e := NewGameSummary(key, value)
+			entry = &e
+		case ArchivedGame:
+			e := NewGameSummary(key, value.Game)
+			e.Archived = true
+			entry = &e
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.keys[key] = struct{}{}
+
+	if entry != nil {
+		r.index(key, *entry)
+	}
+
+	return nil
+}
+
+func (r *IndexedRepository) Erase(key string) error {
+	r.keyLocks.Lock(key)
+	defer r.keyLocks.Unlock(key)
+
+	if err := r.GameRepository.Erase(key); err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.keys, key)
+
+	if e, ok := r.games[key]; ok {
+		r.unindex(key, e, false)
+	}
+
+	return nil
+}
+
+func (r *IndexedRepository) Has(key string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	_, ok := r.keys[key]
+
+	return ok
+}
+
+func (r *IndexedRepository) Contains(key string) bool {
+	return r.Has(key)
+}
+
+func (r *IndexedRepository) Keys(prefix string) ([]string, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	var keys []string
+
+	for key := range r.keys {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// Answer the query from the indexes. The most selective index narrows
+// down the candidates, which are then checked against the other fields.
+func (r *IndexedRepository) QueryGames(q GameQuery) ([]string, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	var candidates map[string]struct{}
+
+	narrow := func(idx hashIndex, value string) {
+		if len(value) == 0 {
+			return
+		}
+		if set := idx[value]; candidates == nil || len(set) < len(candidates) {
+			candidates = set
+		}
+	}
+
+	// Running games may be over by now, only they are certain to be
+	// indexed with the state they are in.
+	narrow(r.byPlayer, q.Player)
+	narrow(r.byHost, q.Host)
+	narrow(r.byWiki, q.Wiki)
+	if q.State == GameRunning {
+		narrow(r.byState, string(q.State))
+	}
+	narrow(r.byWinner, q.Winner)
+
+	var hashes []string
+
+	now := time.Now()
+
+	matches := func(hash string) bool {
+		e := r.games[hash]
+
+		switch {
+		case len(q.Host) > 0 && e.Host != q.Host,
+			len(q.Wiki) > 0 && e.Wiki != q.Wiki,
+			len(q.State) > 0 && e.StateAt(now) != q.State,
+			len(q.Winner) > 0 && e.Winner != q.Winner,
+			q.HasWinner && len(e.Winner) == 0,
+			!q.Since.IsZero() && e.CreatedAt.Before(q.Since),
+			!q.Until.IsZero() && e.CreatedAt.After(q.Until):
+			return false
+		}
+
+		if len(q.Player) > 0 {
+			_, ok := r.byPlayer[q.Player][hash]
+			return ok
+		}
+
+		return true
+	}
+
+	if candidates != nil || len(q.Player) > 0 || len(q.Host) > 0 || len(q.Wiki) > 0 || q.State == GameRunning || len(q.Winner) > 0 {
+		for hash := range candidates {
+			if matches(hash) {
+				hashes = append(hashes, hash)
+			}
+		}
+
+		sort.Strings(hashes)
+
+		return hashes, nil
+	}
+
+	// Only the creation time is restricted, if at all, and maybe
+	// whether there is a winner.
+	i := 0
+
+	if !q.Since.IsZero() {
+		i = sort.Search(len(r.byCreated), func(i int) bool {
+			return !r.byCreated[i].CreatedAt.Before(q.Since)
+		})
+	}
+
+	for ; i < len(r.byCreated); i++ {
+		if !q.Until.IsZero() && r.byCreated[i].CreatedAt.After(q.Until) {
+			break
+		}
+		if matches(r.byCreated[i].Hash) {
+			hashes = append(hashes, r.byCreated[i].Hash)
+		}
+	}
+
+	sort.Strings(hashes)
+
+	return hashes, nil
+}
+
+// Summaries from the index, no game is loaded.
+func (r *IndexedRepository) SummarizeGames(q GameQuery) ([]GameSummary, error) {
+	hashes, err := r.QueryGames(q)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	var summaries []GameSummary
+
+	now := time.Now()
+
+	for _, hash := range hashes {
+		s := r.games[hash]
+		s.State = s.StateAt(now)
+		summaries = append(summaries, s)
+	}
+
+	return summaries, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/githubnemo/wikirace-serv/wikis"
+)
+
+// The indexes have to give the same answers as loading every game.
+func TestIndexedQueriesMatchStore(t *testing.T) {
+	store := NewMemoryStore()
+	base := time.Now()
+
+	for i := 0; i < 20; i++ {
+		game := simpleTwoPlayerGame()
+		game.hash = fmt.Sprintf("game%02d", i)
+		game.Host = fmt.Sprintf("host%d", i%3)
+		game.Wiki = &wikis.Wiki{URL: fmt.Sprintf("http://wiki%d", i%2)}
+		game.CreatedAt = base.Add(time.Duration(i) * time.Hour)
+
+		if i%4 == 0 {
+			game.Ended = true
+		}
+
+		if i%5 == 0 {
+			game.setWinner(game.GetPlayer(fmt.Sprintf("player %d", i%2+1)))
+		}
+
+		store.PutMarshal(game.Hash(), game)
+	}
+
+	indexed, err := NewIndexedRepository(store)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes after the index was built have to be reflected.
+	game := NewGame("", nil, nil)
+	indexed.GetMarshal("game05", game)
+	game.hash = "game05"
+	game.Ended = true
+	game.AddPlayer("player 3")
+	indexed.PutMarshal("game05", game)
+	indexed.Erase("game07")
+
+	queries := []GameQuery{
+		{},
+		{State: GameOver},
+		{State: GameRunning, Host: "host1"},
+		{Wiki: "http://wiki0", Since: base.Add(5 * time.Hour)},
+		{Since: base.Add(3 * time.Hour), Until: base.Add(9 * time.Hour)},
+		{Player: "player 3"},
+		{Player: "nobody"},
+		{Winner: "player 1"},
+		{HasWinner: true},
+		{HasWinner: true, Wiki: "http://wiki1"},
+	}
+
+	for _, q := range queries {
+		expected, _ := store.QueryGames(q)
+		actual, _ := indexed.QueryGames(q)
+
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("query %#v: expected %v, got %v", q, expected, actual)
+		}
+
+		expectedSummaries, _ := store.SummarizeGames(q)
+		actualSummaries, _ := indexed.SummarizeGames(q)
+
+		if string(eventData(expectedSummaries)) != string(eventData(actualSummaries)) {
+			t.Errorf("query %#v: expected summaries %v, got %v", q, expectedSummaries, actualSummaries)
+		}
+	}
+
+	if indexed.Contains("game07") || !indexed.Contains("game08") {
+		t.Errorf("erased game is still known or stored game unknown")
+	}
+}
+
+// Concurrent writes of the same game leave the index with the version
+// that was written last. Run with -race.
+func TestIndexFollowsConcurrentWrites(t *testing.T) {
+	indexed, err := NewIndexedRepository(NewMemoryStore())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func(host string) {
+			defer wg.Done()
+
+			for j := 0; j < 20; j++ {
+				game := NewGame("", nil, nil)
+
+				if indexed.Has("game") {
+					if err := indexed.GetMarshal("game", game); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+
+				game.Host = host
+
+				// Conflicting writes are expected, the next try reads
+				// the newer game.
+				indexed.PutMarshal("game", game)
+			}
+		}(fmt.Sprintf("host %d", i))
+	}
+
+	wg.Wait()
+
+	stored := NewGame("", nil, nil)
+	indexed.GetMarshal("game", stored)
+
+	if hashes, _ := indexed.QueryGames(GameQuery{Host: stored.Host}); len(hashes) != 1 {
+		t.Errorf("Index does not know the stored host %s: %v", stored.Host, indexed.games["game"])
+	}
+}
+
+func BenchmarkIndexedLookups(b *testing.B) {
+	for _, n := range []int{1000, 100000} {
+		store := NewMemoryStore()
+
+		// Every host has ten games regardless of the number of games
+		// so that the size of the query result is the same.
+		for i := 0; i < n; i++ {
+			game := &Game{
+				Host:      fmt.Sprintf("host%d", i/10),
+				Players:   []Player{{Name: fmt.Sprintf("host%d", i/10)}},
+				CreatedAt: time.Unix(int64(i), 0),
+			}
+			store.PutMarshal(fmt.Sprintf("game%d", i), game)
+		}
+
+		indexed, err := NewIndexedRepository(store)
+
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(fmt.Sprintf("Contains/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				indexed.Contains(fmt.Sprintf("game%d", i%n))
+			}
+		})
+
+		b.Run(fmt.Sprintf("QueryHost/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				indexed.QueryGames(GameQuery{Host: "host7", State: GameRunning})
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Kinds of changes to a game.
+type EventType string
+
+const (
+	// The game as it was set up, in Data. Always the first event, also
+	// of compacted journals, where it holds the game as of the
+	// compaction.
+	EventCreated EventType = "created"
+
+	// The player joined, Data is the team.
+	EventJoin EventType = "join"
+
+	// Data holds the teams and the team scoring.
+	EventTeams EventType = "teams"
+
+	// The player visited Page.
+	EventVisit EventType = "visit"
+
+	// The player passed the checkpoint Page.
+	EventCheckpoint EventType = "checkpoint"
+
+	// The player used the hint in Data.
+	EventHint EventType = "hint"
+
+	// The player is the winner, for now or for good.
+	EventWin EventType = "win"
+
+	// Host actions
+	EventKick    EventType = "kick"
+	EventHost    EventType = "host"
+	EventLock    EventType = "lock"
+	EventEnd     EventType = "end"
+	EventInvite  EventType = "invite"
+	EventRematch EventType = "rematch"
+)
+
+// A change of a game. Player and Page are set if the change concerns
+// them, further details depending on the type are in Data.
+type GameEvent struct {
+	// Position in the journal of the game, starting at 1.
+	Seq  int
+	Time time.Time
+	Type EventType
+
+	Player string          `json:",omitempty"`
+	Page   string          `json:",omitempty"`
+	Data   json.RawMessage `json:",omitempty"`
+}
+
+type teamsEventData struct {
+	Teams   []string
+	Scoring TeamScoring
+}
+
+func eventData(v interface{}) json.RawMessage {
+	data, err := json.Marshal(v)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return data
+}
+
+// Apply the change to the game and append it to the journal, if the
+// game has one. Changes are commands, see Do, so they are applied one at
+// a time in the order of the journal. Returns false if the event did not
+// change anything, those are not journaled.
+func (g *Game) change(e GameEvent) bool {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	changed, err := g.apply(e)
+
+	if err != nil {
+		panic(err)
+	}
+
+	if !changed {
+		return false
+	}
+
+	if g.JournalSeq > 0 {
+		g.JournalSeq++
+		e.Seq = g.JournalSeq
+
+		if g.journalHandler != nil {
+			g.journalHandler(g, e)
+		}
+	}
+
+	g.save()
+
+	return true
+}
+
+// Begin the journal with the game as it is now. Changes before that
+// are part of the setup of the game and not journaled.
+func (g *Game) startJournal() {
+	if g.JournalSeq > 0 {
+		return
+	}
+
+	g.JournalSeq = 1
+
+	e := GameEvent{Seq: 1, Time: time.Now(), Type: EventCreated, Data: eventData(g)}
+
+	if g.journalHandler != nil {
+		g.journalHandler(g, e)
+	}
+}
+
+func (g *Game) apply(e GameEvent) (bool, error) {
+	var player *Player
+
+	if len(e.Player) > 0 && e.Type != EventJoin {
+		if player = g.GetPlayer(e.Player); player == nil {
+			return false, fmt.Errorf("Event %d of type %s: no player %q.", e.Seq, e.Type, e.Player)
+		}
+	}
+
+	switch e.Type {
+	case EventCreated:
+		// Start over from the game in Data. The version belongs to the
+		// stored game, not to its state.
+		version := g.Version
+
+		g.Players, g.Wiki, g.Forbidden = nil, nil, nil
+
+		if err := json.Unmarshal(e.Data, g); err != nil {
+			return false, err
+		}
+
+		g.Version = version
+
+	case EventJoin:
+		var team string
+		if len(e.Data) > 0 {
+			if err := json.Unmarshal(e.Data, &team); err != nil {
+				return false, err
+			}
+		}
+		g.addPlayer(e.Player, team, e.Time)
+
+	case EventTeams:
+		var data teamsEventData
+		if err := json.Unmarshal(e.Data, &data); err != nil {
+			return false, err
+		}
+		g.setTeams(data.Teams, data.Scoring)
+
+	case EventVisit:
+		return player.visitedAt(e.Page, e.Time), nil
+
+	case EventCheckpoint:
+		_, ok := player.PassCheckpoint(e.Page, g.Checkpoints, g.CheckpointsInOrder)
+		return ok, nil
+
+	case EventHint:
+		var hint Hint
+		if err := json.Unmarshal(e.Data, &hint); err != nil {
+			return false, err
+		}
+		player.Hints = append(player.Hints, hint)
+
+	case EventWin:
+		g.Winner = player.Name
+		g.WinnerPath = player.Path
+
+		player.LeftGame = true
+
+	case EventKick:
+		player.Kicked = true
+
+	case EventHost:
+		g.Host = player.Name
+
+	case EventLock:
+		if err := json.Unmarshal(e.Data, &g.Locked); err != nil {
+			return false, err
+		}
+
+	case EventEnd:
+		g.Ended = true
+
+	case EventInvite:
+		if err := json.Unmarshal(e.Data, &g.InviteNonce); err != nil {
+			return false, err
+		}
+
+	case EventRematch:
+		if err := json.Unmarshal(e.Data, &g.Rematch); err != nil {
+			return false, err
+		}
+
+	default:
+		return false, fmt.Errorf("Event %d has unknown type %q.", e.Seq, e.Type)
+	}
+
+	return true, nil
+}
+
+// Apply the events following the last event included in the game.
+// Earlier events are skipped, the events have to be in order. The
+// creation of the game at the start of a compacted journal may follow
+// any event, it replaces the game.
+func (g *Game) Replay(events []GameEvent) (err error) {
+	g.Do(func() {
+		err = g.replay(events)
+	})
+
+	return
+}
+
+func (g *Game) replay(events []GameEvent) error {
+	for _, e := range events {
+		if e.Seq <= g.JournalSeq {
+			continue
+		}
+
+		if e.Seq != g.JournalSeq+1 && e.Type != EventCreated {
+			return fmt.Errorf("Event %d is missing in the journal.", g.JournalSeq+1)
+		}
+
+		if _, err := g.apply(e); err != nil {
+			return err
+		}
+
+		g.JournalSeq = e.Seq
+	}
+
+	return nil
+}
+
+// Rebuild a game from its complete journal.
+func ReplayGame(events []GameEvent) (*Game, error) {
+	if len(events) == 0 || events[0].Type != EventCreated {
+		return nil, fmt.Errorf("The journal does not start with the creation of the game.")
+	}
+
+	game := NewGame("", nil, nil)
+
+	if err := game.Replay(events); err != nil {
+		return nil, err
+	}
+
+	return game, nil
+}
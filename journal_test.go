@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestJournalReplay(t *testing.T) {
+	repository := NewMemoryStore()
+	store := NewGameStore(repository, NewMemoryStore())
+
+	// The journal is written behind like the snapshot, with the next
+	// flush.
+	persister := store.WriteBehind(time.Hour)
+
+	game := NewGame("host", nil, nil)
+	game.hash = "game"
+	game.Start = "start"
+	game.Goal = "goal"
+	game.saveHandler = store.gameSaveHandler
+	game.journalHandler = store.journalHandler
+
+	if err := store.PutGame(game); err != nil {
+		t.Fatal(err)
+	}
+
+	game.AddPlayer("guest")
+
+	host, guest := game.GetPlayer("host"), game.GetPlayer("guest")
+
+	game.Visit(host, "somewhere")
+	game.Visit(host, "somewhere")
+	game.AddHint(host, Hint{Kind: HintLink, Page: "somewhere", Text: "goal"})
+	game.SetLocked(true)
+	game.Visit(guest, "goal")
+	game.EvaluateWinner(guest)
+
+	if events, _ := store.Journal("game", 0); len(events) > 0 {
+		t.Errorf("Journal was written before the flush: %v", events)
+	}
+
+	if err := persister.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := store.Journal("game", 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var types []EventType
+
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+
+	expected := []EventType{EventCreated, EventJoin, EventVisit, EventHint, EventLock, EventVisit, EventWin}
+
+	if !reflect.DeepEqual(types, expected) {
+		t.Fatalf("Expected events %v, got %v", expected, types)
+	}
+
+	replayed, err := ReplayGame(events)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The snapshot only has the state up to the creation, the rest is
+	// replayed from the journal when the game is loaded.
+	loaded, err := NewGameStore(repository, NewMemoryStore()).GetGameByHash("game")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, g := range map[string]*Game{"replayed": replayed, "loaded": loaded} {
+		if g.Winner != "guest" || !g.Locked || g.JournalSeq != len(events) {
+			t.Errorf("%s: wrong game state: winner %q, locked %v, seq %d", name, g.Winner, g.Locked, g.JournalSeq)
+		}
+
+		if string(eventData(g.Players)) != string(eventData(game.Players)) {
+			t.Errorf("%s: players differ:\n%+v\n%+v", name, g.Players, game.Players)
+		}
+	}
+}
+
+func TestReplayNeedsCompleteJournal(t *testing.T) {
+	game := NewGame("host", nil, nil)
+
+	events := []GameEvent{
+		{Seq: 1, Type: EventCreated, Data: eventData(game)},
+		{Seq: 3, Type: EventLock, Data: eventData(true)},
+	}
+
+	if _, err := ReplayGame(events); err == nil {
+		t.Error("Journal with a missing event was replayed.")
+	}
+
+	if _, err := ReplayGame(events[1:]); err == nil {
+		t.Error("Journal without creation was replayed.")
+	}
+}
+
+// Long journals are started over with the game as of their last event,
+// under the one key of the game.
+func TestJournalCompaction(t *testing.T) {
+	repository := NewMemoryStore()
+	store := NewGameStore(repository, NewMemoryStore())
+
+	game := NewGame("host", nil, nil)
+	game.hash = "game"
+	game.saveHandler = store.gameSaveHandler
+	game.journalHandler = store.journalHandler
+
+	if err := store.PutGame(game); err != nil {
+		t.Fatal(err)
+	}
+
+	host := game.PlayerCopy("host")
+
+	for i := 0; i < 2*maxJournalLength; i++ {
+		game.Visit(host, fmt.Sprintf("page %d", i))
+	}
+
+	if keys, _ := repository.Keys("journal-"); len(keys) != 1 {
+		t.Errorf("Expected the journal under one key, got %v", keys)
+	}
+
+	events, err := store.Journal("game", 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) == 0 || len(events) > maxJournalLength || events[0].Type != EventCreated {
+		t.Fatalf("Journal was not compacted: %d events", len(events))
+	}
+
+	replayed, err := ReplayGame(events)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p := replayed.GetPlayer("host"); p == nil || len(p.Path) != len(game.PlayerCopy("host").Path) {
+		t.Errorf("Compacted journal lost visits: %v", p)
+	}
+
+	if replayed.JournalSeq != game.Snapshot().JournalSeq {
+		t.Errorf("Expected seq %d, got %d", game.Snapshot().JournalSeq, replayed.JournalSeq)
+	}
+}
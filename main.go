@@ -1,21 +1,47 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"crypto/rand"
 	"io"
 	"os"
+	"os/signal"
 	"syscall"
 
 	"github.com/githubnemo/wikirace-serv/wikis"
 )
 
+var (
+	expiryInterval  = flag.Duration("expiry-interval", time.Minute, "how often expired games are evicted, archived and deleted")
+	idleTTL         = flag.Duration("idle-ttl", DefaultExpiryPolicy.IdleTTL, "drop games from memory that were not requested for this long")
+	archiveAfter    = flag.Duration("archive-after", DefaultExpiryPolicy.ArchiveAfter, "archive finished games that were not changed for this long")
+	abandonAfter    = flag.Duration("abandon-after", DefaultExpiryPolicy.AbandonAfter, "archive unfinished games that were not changed for this long")
+	retention       = flag.Duration("retention", DefaultExpiryPolicy.Retention, "delete archived games after this long")
+	dailyTimeZone   = flag.String("daily-timezone", "UTC", "time zone in which a new daily challenge starts at midnight")
+	storeSpec       = flag.String("store", "diskv:./games", "where games are stored: diskv:<dir>, bolt:<file> or memory")
+	flushDelay      = flag.Duration("flush-delay", 5*time.Second, "write changed games at most this long after the change")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "how long open requests may take when the server shuts down")
+)
+
+func expiryPolicy() ExpiryPolicy {
+	return ExpiryPolicy{
+		IdleTTL:      *idleTTL,
+		ArchiveAfter: *archiveAfter,
+		AbandonAfter: *abandonAfter,
+		Retention:    *retention,
+	}
+}
+
 // Initialized in main()
 var (
 	session    *GameSessionStore
@@ -55,6 +81,18 @@ func mustGetGameSession(r *http.Request) *GameSession {
 	return session
 }
 
+// The name of the player if the session belongs to the game with the
+// given hash, empty otherwise. Players may watch their own game.
+func spectatorName(r *http.Request, hash string) string {
+	session, err := session.GetGameSession(r)
+
+	if err != nil || !session.IsInitialized() || session.GameHash() != hash {
+		return ""
+	}
+
+	return session.PlayerName()
+}
+
 // Returned GameSession is initialized and ready to use.
 func mustGetValidGameSession(r *http.Request) *GameSession {
 	session := mustGetGameSession(r)
@@ -100,30 +138,78 @@ func visitHandler(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
-	player.Visited(page)
+	settings := game.Snapshot()
+
+	if settings.Ended {
+		panic(ErrGameEnded(game.Hash()))
+	}
+
+	if forbidden, err := settings.Forbidden.IsForbidden(settings.Wiki, page); err != nil {
+		panic(err)
+	} else if forbidden {
+		panic(ErrForbiddenPage(page))
+	}
+
+	visit, err := game.VisitPage(player.Name, page)
+
+	if err != nil {
+		panic(err)
+	}
+
+	player = visit.Player
+
+	if visit.PassedCheckpoint {
+		game.Broadcast(NewCheckpointMessage(session, player, visit.Checkpoint, len(settings.Checkpoints)))
+	}
+
+	// He reached the goal after passing all checkpoints. Without all
+	// checkpoints the goal is just another page.
+	if visit.Finished {
+		standings := visit.Standings
+		teamStandings := visit.TeamStandings
 
-	// He reached the goal
-	if page == game.Goal {
+		scoreRoundIfOver(game)
 
-		isWinner, isTemporaryWinner := game.EvaluateWinner(player)
+		if len(settings.Daily) > 0 {
+			daily, err := gameStore.GetDailyByKey(settings.Daily)
+
+			if err != nil {
+				panic(ErrNoSuchDaily(err))
+			}
+
+			result := daily.AddResult(game, player)
+
+			templates.MustExecuteTemplate(w, "daily.html", struct {
+				Daily  *DailyChallenge
+				Result *DailyResult
+			}{daily, &result})
+
+			return
+		}
 
 		switch {
-		case isWinner:
-			game.Broadcast(GameMessage(NewGameOverMessage(session)))
-		case isTemporaryWinner:
-			game.Broadcast(GameMessage(NewFinishMessage(session)))
+		case visit.IsWinner:
+			game.Broadcast(GameMessage(NewGameOverMessage(session, standings, teamStandings)))
+		case visit.IsTemporaryWinner:
+			game.Broadcast(GameMessage(NewFinishMessage(session, standings, teamStandings)))
 		}
 
 		templates.MustExecuteTemplate(w, "win.html", struct {
 			Game            *Game
 			Player          *Player
+			Standings       Standings
+			Standing        *Standing
+			TeamStandings   TeamStandings
 			IsWinner        bool
 			WinningPageLink string
 		}{
-			game,
+			game.Snapshot(),
 			player,
-			game.Winner == player.Name,
-			game.Wiki.PageLink(page),
+			standings,
+			standings.Get(player.Name),
+			teamStandings,
+			visit.IsTemporaryWinner,
+			settings.Wiki.PageLink(page),
 		})
 
 		return
@@ -131,24 +217,94 @@ func visitHandler(w http.ResponseWriter, r *http.Request) {
 
 	game.Broadcast(NewVisitMessage(session, page, player))
 
-	game.Wiki.ServeWikiPage(page, w)
+	settings.Wiki.ServeFilteredWikiPage(page, w, settings.Forbidden.Filter)
 
 	fmt.Fprintf(w, "Session dump: %#v\n", session.Values)
-	fmt.Fprintf(w, "Game dump: %#v\n", game)
+	fmt.Fprintf(w, "Game dump: %#v\n", game.Snapshot())
 	fmt.Fprintf(w, "Player dump: %#v\n", player)
 }
 
+// Resolve the canonical titles of the checkpoints, one per line.
+func resolveCheckpoints(wiki *wikis.Wiki, list string) ([]string, error) {
+	var checkpoints []string
+
+	for _, title := range splitLines(list) {
+		checkpoint, err := wiki.ResolveTitle(title)
+
+		if err != nil {
+			return nil, err
+		}
+
+		checkpoints = append(checkpoints, checkpoint)
+	}
+
+	return checkpoints, nil
+}
+
+// Split the comma separated list of team names, dropping empty
+// and duplicate names.
+func parseTeams(list string) []string {
+	var teams []string
+
+	seen := make(map[string]bool)
+
+	for _, team := range strings.Split(list, ",") {
+		team = strings.TrimSpace(team)
+
+		if len(team) > 0 && !seen[team] {
+			seen[team] = true
+			teams = append(teams, team)
+		}
+	}
+
+	return teams
+}
+
+// Award the points of the game to the players of its match once the
+// game is over, no matter if it was won, ended by the host or nobody
+// is left racing. Running games and games outside of matches are left
+// alone.
+func scoreRoundIfOver(game *Game) {
+	hash := game.Snapshot().Match
+
+	if len(hash) == 0 || !game.IsOver() {
+		return
+	}
+
+	match, err := gameStore.GetMatchByHash(hash)
+
+	if err != nil {
+		panic(ErrNoSuchMatch(hash))
+	}
+
+	if err := match.ScoreRound(game); err != nil {
+		panic(err)
+	}
+}
+
 // start game session
 // params:
 // - your name
+// - number of rounds (optional, starts a match if > 1)
+// - start page (optional)
+// - goal page (optional)
+// - teams, comma separated (optional, starts a team race)
+// - team scoring, best or average (optional)
+// - forbidden pages, patterns and categories, one per line (optional)
+// - checkpoints, one per line, and whether they are in order (optional)
+// - hint penalty in clicks (optional)
+// - time limit in minutes (optional)
 //
-// sets randomly
-// - start page
-// - end page
+// start and goal page are set randomly when not given
 func startHandler(w http.ResponseWriter, r *http.Request) {
 	values := mustParseQuery(r.URL.RawQuery)
 
-	playerName := values.Get("playerName")
+	playerName, err := ValidateName(values.Get("playerName"))
+
+	if err != nil {
+		panic(err)
+	}
+
 	wikiUrl := values.Get("wikiLanguage")
 	wiki := wikis.ByURL(wikiUrl)
 
@@ -156,19 +312,83 @@ func startHandler(w http.ResponseWriter, r *http.Request) {
 		panic("No wiki found for: " + wikiUrl)
 	}
 
+	forbidden, err := ParseForbiddenPages(
+		values.Get("forbiddenPages"),
+		values.Get("forbiddenPatterns"),
+		values.Get("forbiddenCategories"))
+
+	if err != nil {
+		panic(ErrForbiddenRules(err))
+	}
+
+	start, goal, err := wiki.ChooseStartAndGoal(values.Get("start"), values.Get("goal"))
+
+	if err != nil {
+		panic(ErrChooseStartAndGoal(err))
+	}
+
+	checkpoints, err := resolveCheckpoints(wiki, values.Get("checkpoints"))
+
+	if err != nil {
+		panic(ErrChooseStartAndGoal(err))
+	}
+
+	for _, page := range append([]string{start, goal}, checkpoints...) {
+		if isForbidden, err := forbidden.IsForbidden(wiki, page); err != nil {
+			panic(ErrStartAndGoal(err))
+		} else if isForbidden {
+			panic(ErrForbiddenStartOrGoal(page))
+		}
+	}
+
 	// FIXME: overwrites running game of the player
 	game := gameStore.NewGame(playerName, wiki)
 
-	start, goal, err := wiki.DetermineStartAndGoal()
+	if len(values.Get("private")) > 0 || len(values.Get("password")) > 0 {
+		if err := game.MakePrivate(values.Get("password")); err != nil {
+			panic(ErrInvalidPassword(err))
+		}
+	}
 
-	if err != nil {
-		panic(ErrStartAndGoal(err))
+	if maxPlayers, _ := strconv.Atoi(values.Get("maxPlayers")); maxPlayers > 0 {
+		game.MaxPlayers = maxPlayers
+	}
+
+	if minutes, _ := strconv.Atoi(values.Get("timeLimit")); minutes > 0 {
+		game.TimeLimit = time.Duration(minutes) * time.Minute
 	}
 
 	game.Start = start
 	game.Goal = goal
 
-	err = gameStore.PutMarshal(game.Hash(), game)
+	if !forbidden.IsEmpty() {
+		game.Forbidden = forbidden
+	}
+
+	game.Checkpoints = checkpoints
+	game.CheckpointsInOrder = len(values.Get("checkpointsInOrder")) > 0
+
+	game.HintPenalty = DefaultHintPenalty
+
+	if penalty, err := strconv.Atoi(values.Get("hintPenalty")); err == nil && penalty >= 0 {
+		game.HintPenalty = penalty
+	}
+
+	if teams := parseTeams(values.Get("teams")); len(teams) > 0 {
+		if len(teams) < 2 {
+			panic(ErrTooFewTeams())
+		}
+
+		game.SetTeams(teams, ParseTeamScoring(values.Get("teamScoring")))
+	}
+
+	if rounds, _ := strconv.Atoi(values.Get("rounds")); rounds > 1 {
+		match := gameStore.NewMatch(playerName, wiki, rounds)
+		game.Match = match.Hash()
+		match.AddRound(game)
+	}
+
+	err = gameStore.PutGame(game)
 
 	if err != nil {
 		panic(ErrGameMarshal(err))
@@ -206,14 +426,12 @@ func joinHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(playerName) == 0 {
-		templates.ExecuteTemplate(w, "join.html", gameId)
-		log.Println("someone tried to join a game without a playername")
-		return
-	}
-
 	// Check if game really exists
 	if !gameStore.Contains(gameId) {
+		if gameStore.IsArchived(gameId) {
+			panic(ErrGameArchived(gameId))
+		}
+
 		log.Println("there was a game that was not found")
 		panic(ErrNoSuchGame(gameId))
 	}
@@ -225,7 +443,45 @@ func joinHandler(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
-	if err := game.CanJoin(playerName); err != nil {
+	// Spectators don't need a name and may watch finished games as
+	// well. Private games need the credentials to join.
+	if len(values.Get("spectate")) > 0 {
+		spectate := url.Values{"id": {gameId}}
+
+		for _, key := range []string{"token", "password"} {
+			if len(values.Get(key)) > 0 {
+				spectate.Set(key, values.Get(key))
+			}
+		}
+
+		http.Redirect(w, r, "/spectate?"+spectate.Encode(), 301)
+		return
+	}
+
+	if len(playerName) == 0 {
+		templates.ExecuteTemplate(w, "join.html", struct {
+			*Game
+			Token string
+		}{game.Snapshot(), values.Get("token")})
+		log.Println("someone tried to join a game without a playername")
+		return
+	}
+
+	playerName, err = ValidateName(playerName)
+
+	if err != nil {
+		panic(err)
+	}
+
+	team := values.Get("team")
+
+	if len(team) > 0 && !game.HasTeam(team) {
+		panic(ErrNoSuchTeam(team))
+	}
+
+	credentials := JoinCredentials{values.Get("password"), values.Get("token")}
+
+	if err := game.Join(playerName, team, credentials); err != nil {
 		log.Println(err.Error())
 		panic(err)
 	}
@@ -235,7 +491,15 @@ func joinHandler(w http.ResponseWriter, r *http.Request) {
 	session.Init(playerName, gameId)
 	session.Save(r, w)
 
-	game.AddPlayer(playerName)
+	if hash := game.Snapshot().Match; len(hash) > 0 {
+		match, err := gameStore.GetMatchByHash(hash)
+
+		if err != nil {
+			panic(ErrNoSuchMatch(hash))
+		}
+
+		match.AddPlayer(playerName)
+	}
 
 	log.Println("all good, trying to redirect to game", gameId)
 	http.Redirect(w, r, "/game?id="+gameId, 301)
@@ -294,11 +558,21 @@ func gameHandler(w http.ResponseWriter, r *http.Request) {
 		panic(ErrGetGame(err))
 	}
 
-	summary, err := game.Wiki.FirstParagraph(game.Goal)
+	// Kicked players lose their session for this game for good.
+	if p := game.PlayerCopy(session.PlayerName()); p != nil && p.Kicked {
+		session.Invalidate()
+		session.Save(r, w)
+
+		panic(ErrKicked(p.Name))
+	}
+
+	settings := game.Snapshot()
+
+	summary, err := settings.Wiki.FirstParagraph(settings.Goal)
 
 	if err != nil {
 		summary = err.Error()
-		log.Printf("Error fetching summary for game %#v: %s\n", game, err)
+		log.Printf("Error fetching summary for game %s: %s\n", game.Hash(), err)
 	}
 
 	player, err := PlayerFromSession(session)
@@ -314,7 +588,419 @@ func gameHandler(w http.ResponseWriter, r *http.Request) {
 		Summary string
 		WikiURL string
 		Player  *Player
-	}{game, summary, wikiUrl, player})
+	}{game.Snapshot(), summary, wikiUrl, player})
+}
+
+func mustGetMatch(r *http.Request) *Match {
+	matchId := mustParseQuery(r.URL.RawQuery).Get("id")
+
+	match, err := gameStore.GetMatchByHash(matchId)
+
+	if err != nil {
+		panic(ErrNoSuchMatch(matchId))
+	}
+
+	return match
+}
+
+// Serve the scoreboard of a match.
+//
+// Parameters: id
+func matchHandler(w http.ResponseWriter, r *http.Request) {
+	match := mustGetMatch(r)
+	session := mustGetGameSession(r)
+
+	var rounds []*Game
+
+	for _, hash := range match.RoundHashes() {
+		game, err := gameStore.GetGameByHash(hash)
+
+		if err != nil {
+			panic(ErrGetGame(err))
+		}
+
+		rounds = append(rounds, game)
+	}
+
+	templates.MustExecuteTemplate(w, "match.html", struct {
+		Match      *Match
+		Scoreboard []Score
+		Rounds     []*Game
+		IsHost     bool
+		IsPlayer   bool
+	}{
+		match,
+		match.Scoreboard(),
+		rounds,
+		session.IsInitialized() && session.PlayerName() == match.Host,
+		session.IsInitialized() && match.HasPlayer(session.PlayerName()),
+	})
+}
+
+// Start the next round of a match. Only the host may do this.
+// All players of the previous round are notified so that they can follow.
+//
+// Parameters: id
+func nextRoundHandler(w http.ResponseWriter, r *http.Request) {
+	match := mustGetMatch(r)
+	session := mustGetValidGameSession(r)
+
+	if session.PlayerName() != match.Host {
+		panic(ErrNotHost(session.PlayerName()))
+	}
+
+	previous, err := gameStore.GetGameByHash(match.CurrentRound())
+
+	if err != nil {
+		panic(ErrGetGame(err))
+	}
+
+	// The round may be over without anybody visiting a page since,
+	// e.g. when the time limit ran out.
+	scoreRoundIfOver(previous)
+
+	if !match.CanStartNextRound() {
+		panic(ErrNoNextRound(match.Hash()))
+	}
+
+	game, err := gameStore.NewRound(match)
+
+	if err != nil {
+		panic(err)
+	}
+
+	previous.Broadcast(NewNextRoundMessage(session, match))
+
+	session.Init(session.PlayerName(), game.Hash())
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/game?id="+game.Hash(), 301)
+}
+
+// Move the player to the current round of the match.
+//
+// Parameters: id
+func matchPlayHandler(w http.ResponseWriter, r *http.Request) {
+	match := mustGetMatch(r)
+	session := mustGetValidGameSession(r)
+
+	if !match.HasPlayer(session.PlayerName()) {
+		panic(ErrNotInMatch(session.PlayerName(), match.Hash()))
+	}
+
+	session.Init(session.PlayerName(), match.CurrentRound())
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/game?id="+match.CurrentRound(), 301)
+}
+
+// Start a rematch of a finished game or join the rematch if it was
+// already started. All players connected to the finished game are
+// moved to the rematch and notified so that they can follow.
+//
+// Parameters: id
+func rematchHandler(w http.ResponseWriter, r *http.Request) {
+	gameId := mustParseQuery(r.URL.RawQuery).Get("id")
+	session := mustGetValidGameSession(r)
+
+	if !gameStore.Contains(gameId) {
+		panic(ErrNoSuchGame(gameId))
+	}
+
+	game, err := gameStore.GetGameByHash(gameId)
+
+	if err != nil {
+		panic(ErrGetGame(err))
+	}
+
+	// The session may already belong to the rematch, so we only check
+	// that the player took part in the game.
+	if !game.HasPlayer(session.PlayerName()) {
+		panic(ErrPlayerLoad(fmt.Errorf("Player %s is not in the game %s.", session.PlayerName(), gameId)))
+	}
+
+	if !game.IsOver() {
+		panic(ErrGameNotOver(game.Hash()))
+	}
+
+	players := append(ClientHandler.ConnectedPlayers(game.Hash()), session.PlayerName())
+
+	rematch, created, err := gameStore.NewRematch(game, session.PlayerName(), players)
+
+	if err != nil {
+		panic(err)
+	}
+
+	if created {
+		game.Broadcast(NewRematchMessage(session, game, rematch))
+	}
+
+	// Players that were not connected when the rematch was started
+	// are added when they follow.
+	if !rematch.HasPlayer(session.PlayerName()) {
+		// Players of the previous game are invited to the rematch.
+		invite := JoinCredentials{Token: rematch.InviteToken()}
+
+		if err := rematch.Join(session.PlayerName(), "", invite); err != nil {
+			panic(err)
+		}
+	}
+
+	session.Init(session.PlayerName(), rematch.Hash())
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/game?id="+rematch.Hash(), 301)
+}
+
+// Suggest article titles for the start and goal fields at /start.
+// Responds with a JSON list of titles.
+//
+// Parameters: wiki, q
+func suggestHandler(w http.ResponseWriter, r *http.Request) {
+	values := mustParseQuery(r.URL.RawQuery)
+
+	wiki := mustGetWiki(r)
+	titles := []string{}
+
+	if len(values.Get("q")) > 0 {
+		result, err := wiki.Search(values.Get("q"), 10)
+
+		if err != nil {
+			log.Println("Error fetching suggestions:", err)
+		} else if result != nil {
+			titles = result
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(titles); err != nil {
+		panic(err)
+	}
+}
+
+// Give the player a hint on the way to the goal. The hint is recorded
+// and adds a penalty to the score of the player. Responds with the hint
+// as JSON.
+//
+// Parameters: kind (category or link)
+func hintHandler(w http.ResponseWriter, r *http.Request) {
+	kind := mustParseQuery(r.URL.RawQuery).Get("kind")
+	session := mustGetValidGameSession(r)
+
+	game, err := session.GetGame()
+
+	if err != nil {
+		panic(ErrGetGame(err))
+	}
+
+	player, err := PlayerFromSession(session)
+
+	if err != nil {
+		panic(ErrPlayerLoad(err))
+	}
+
+	if s := game.Standings().Get(player.Name); s == nil || s.Status != StatusRacing {
+		panic(ErrNotRacing(player.Name))
+	}
+
+	// The hints ask the wiki, which must not hold up the game.
+	settings := game.Snapshot()
+
+	hint, err := FindHint(settings, player, kind)
+
+	if err != nil {
+		panic(ErrHint(err))
+	}
+
+	game.AddHint(player, hint)
+
+	if player, err = PlayerFromSession(session); err != nil {
+		panic(ErrPlayerLoad(err))
+	}
+
+	game.Broadcast(NewHintMessage(session, player, kind, settings.HintPenalty))
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(struct {
+		Hint
+		Penalty int
+	}{hint, len(player.Hints) * settings.HintPenalty}); err != nil {
+		panic(err)
+	}
+}
+
+// The wiki given by the wiki parameter, unknown wikis are refused.
+func mustGetWiki(r *http.Request) *wikis.Wiki {
+	wikiUrl := mustParseQuery(r.URL.RawQuery).Get("wiki")
+
+	if _, ok := wikis.Wikis()[wikiUrl]; !ok {
+		panic(ErrNoSuchWiki(wikiUrl))
+	}
+
+	return wikis.ByURL(wikiUrl)
+}
+
+// Today's daily challenge of a wiki and its leaderboard.
+//
+// Parameters: wiki
+func dailyHandler(w http.ResponseWriter, r *http.Request) {
+	daily, err := gameStore.GetDaily(mustGetWiki(r), DailyDay(time.Now()))
+
+	if err != nil {
+		panic(ErrNoSuchDaily(err))
+	}
+
+	templates.MustExecuteTemplate(w, "daily.html", struct {
+		Daily  *DailyChallenge
+		Result *DailyResult
+	}{daily, nil})
+}
+
+// Start a solo game of today's daily challenge.
+//
+// Parameters: wiki, playerName
+func dailyPlayHandler(w http.ResponseWriter, r *http.Request) {
+	playerName, err := ValidateName(mustParseQuery(r.URL.RawQuery).Get("playerName"))
+
+	if err != nil {
+		panic(err)
+	}
+
+	daily, err := gameStore.GetDaily(mustGetWiki(r), DailyDay(time.Now()))
+
+	if err != nil {
+		panic(ErrNoSuchDaily(err))
+	}
+
+	if daily.HasPlayed(playerName) {
+		panic(ErrDailyPlayed(playerName))
+	}
+
+	game, err := gameStore.NewDailyGame(daily, playerName)
+
+	if err != nil {
+		panic(err)
+	}
+
+	session := mustGetGameSession(r)
+
+	session.Init(playerName, game.Hash())
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/game?id="+game.Hash(), 303)
+}
+
+// Moderation of the game by the host. The host is identified by his
+// session, the action is applied to the game of the session.
+//
+// Parameters: action (kick, transfer, lock, unlock, rotate, end), player
+func hostHandler(w http.ResponseWriter, r *http.Request) {
+	values := mustParseQuery(r.URL.RawQuery)
+	action := values.Get("action")
+	playerName := values.Get("player")
+
+	session := mustGetValidGameSession(r)
+
+	game, err := session.GetGame()
+
+	if err != nil {
+		panic(ErrGetGame(err))
+	}
+
+	if !game.IsHost(session.PlayerName()) {
+		panic(ErrNotHost(session.PlayerName()))
+	}
+
+	switch action {
+	case "kick":
+		if err := game.Kick(playerName); err != nil {
+			panic(err)
+		}
+
+		game.Broadcast(NewKickMessage(session, playerName))
+
+	case "transfer":
+		if err := game.TransferHost(playerName); err != nil {
+			panic(err)
+		}
+
+		game.Broadcast(NewHostChangeMessage(session, playerName))
+
+	case "lock", "unlock":
+		game.SetLocked(action == "lock")
+
+		game.Broadcast(NewLockMessage(session, action == "lock"))
+
+	case "rotate":
+		if !game.Snapshot().Private {
+			panic(ErrUnknownHostAction(action))
+		}
+
+		game.RotateInviteToken()
+
+	case "end":
+		if game.Rules().Ended {
+			panic(ErrGameEnded(game.Hash()))
+		}
+
+		game.End()
+
+		game.Broadcast(NewGameEndMessage(session, game))
+
+	default:
+		panic(ErrUnknownHostAction(action))
+	}
+
+	// Kicking the last racer can end the game as well.
+	scoreRoundIfOver(game)
+
+	http.Redirect(w, r, "/game?id="+game.Hash(), 303)
+}
+
+// Serve the live view of a game for spectators. Spectators are not
+// players and don't need a session. Archived games are shown as they
+// were when they were archived.
+//
+// Parameters: id
+func spectateHandler(w http.ResponseWriter, r *http.Request) {
+	values := mustParseQuery(r.URL.RawQuery)
+	gameId := values.Get("id")
+
+	var game *Game
+
+	if gameStore.Contains(gameId) {
+		var err error
+
+		if game, err = gameStore.GetGameByHash(gameId); err != nil {
+			panic(ErrGetGame(err))
+		}
+	} else if archived, err := gameStore.GetArchivedGame(gameId); err == nil {
+		game = archived.Game
+	} else {
+		panic(ErrNoSuchGame(gameId))
+	}
+
+	credentials := JoinCredentials{values.Get("password"), values.Get("token")}
+
+	if err := game.CanSpectate(spectatorName(r, gameId), credentials); err != nil {
+		panic(err)
+	}
+
+	// The websocket of the spectator is opened with the invite token,
+	// the password is not passed on.
+	token := ""
+
+	if game.Snapshot().Private {
+		token = game.InviteToken()
+	}
+
+	templates.MustExecuteTemplate(w, "spectate.html", struct {
+		Game      *Game
+		Standings Standings
+		Token     string
+	}{game.Snapshot(), game.Standings(), token})
 }
 
 // Serves initial page
@@ -323,7 +1009,13 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func reloadHandler(w http.ResponseWriter, r *http.Request) {
-	var err error
+	rules, err := ReadNameRules("config/name_rules")
+
+	if err != nil {
+		panic(err)
+	}
+
+	SetNameRules(rules)
 
 	templates, err = parseTemplates()
 
@@ -335,12 +1027,24 @@ func reloadHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func setupPageCipher() (*PageCipher, error) {
-	key, err := ioutil.ReadFile("./config/key")
+	key, err := setupKey("./config/key", PAGE_CIPHER_KEY_LENGTH)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewPageCipher(key)
+}
+
+// Read the key from the given file. If there is no such file, a random
+// key of the given length is created.
+func setupKey(path string, length int64) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
 
 	if err != nil {
 		if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ENOENT {
 			// Key not found, create a random key
-			file, err := os.OpenFile("./config/key", os.O_WRONLY|os.O_CREATE, 0600)
+			file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
 
 			if err != nil {
 				// Give up in being convenient
@@ -349,19 +1053,19 @@ func setupPageCipher() (*PageCipher, error) {
 
 			defer file.Close()
 
-			_, err = io.CopyN(file, rand.Reader, PAGE_CIPHER_KEY_LENGTH)
+			_, err = io.CopyN(file, rand.Reader, length)
 
 			if err != nil {
 				return nil, err
 			}
 
 			// Try once again to read the file
-			return setupPageCipher()
+			return setupKey(path, length)
 		}
 		return nil, err
 	}
 
-	return NewPageCipher(key)
+	return key, nil
 }
 
 // TODO: Player leave messages
@@ -381,6 +1085,23 @@ func setupPageCipher() (*PageCipher, error) {
 func main() {
 	var err error
 
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
+	flag.Parse()
+
+	dailyLocation, err = time.LoadLocation(*dailyTimeZone)
+
+	if err != nil {
+		log.Fatal("Invalid daily time zone: ", err)
+	}
+
 	err = wikis.ReadSupportedWikis("config/supported_wikis")
 
 	wikis.Config.PageRenderer = WikiPageRenderer
@@ -398,24 +1119,101 @@ func main() {
 		log.Fatal("Unable to parse templates: ", err)
 	}
 
+	rules, err := ReadNameRules("config/name_rules")
+
+	if err != nil {
+		log.Fatal("Error reading name rules: ", err)
+	}
+
+	SetNameRules(rules)
+
 	pageCipher, err = setupPageCipher()
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	gameStore = NewGameStore(NewStore("./games"))
+	inviteKey, err = setupKey("./config/invite_key", INVITE_KEY_LENGTH)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Held until the server exits, so that games are not imported
+	// behind its back, see ImportGames.
+	if _, err := LockStore(*storeSpec); err != nil {
+		log.Fatal("Error locking store: ", err)
+	}
+
+	store, err := OpenStore(*storeSpec)
+
+	if err != nil {
+		log.Fatal("Error opening store: ", err)
+	}
+
+	indexed, err := NewIndexedRepository(store)
+
+	if err != nil {
+		log.Fatal("Error indexing games: ", err)
+	}
+
+	archive := NewCompressedStore("./archive")
+
+	indexedArchive, err := NewIndexedRepository(archive)
+
+	if err != nil {
+		log.Fatal("Error indexing archived games: ", err)
+	}
+
+	gameStore = NewGameStore(indexed, indexedArchive)
+
+	persister := gameStore.WriteBehind(*flushDelay)
+
+	go persister.Run()
+
+	server := &http.Server{Addr: ":8080"}
+	stopped := make(chan struct{})
+
+	// Write the remaining changes before exiting.
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+		<-signals
+
+		log.Println("Shutting down ...")
+
+		shutdown(server, persister, *shutdownTimeout, store, archive)
+		close(stopped)
+	}()
+
+	go gameStore.RunExpiry(expiryPolicy(), *expiryInterval)
 
 	http.HandleFunc("/", errorHandler(indexHandler))
 	http.HandleFunc("/reload", errorHandler(reloadHandler))
 	http.HandleFunc("/visit", errorHandler(visitHandler))
 	http.HandleFunc("/start", errorHandler(startHandler))
+	http.HandleFunc("/suggest", errorHandler(suggestHandler))
+	http.HandleFunc("/hint", errorHandler(hintHandler))
 	http.HandleFunc("/game", errorHandler(gameHandler))
 	http.HandleFunc("/join", errorHandler(joinHandler))
+	http.HandleFunc("/spectate", errorHandler(spectateHandler))
+	http.HandleFunc("/host", errorHandler(hostHandler))
+	http.HandleFunc("/rematch", errorHandler(rematchHandler))
+	http.HandleFunc("/daily", errorHandler(dailyHandler))
+	http.HandleFunc("/daily/play", errorHandler(dailyPlayHandler))
+	http.HandleFunc("/api/games", errorHandler(apiGamesHandler))
+	http.HandleFunc("/match", errorHandler(matchHandler))
+	http.HandleFunc("/match/next", errorHandler(nextRoundHandler))
+	http.HandleFunc("/match/play", errorHandler(matchPlayHandler))
 
 	http.Handle("/js/", http.StripPrefix("/js/", http.FileServer(http.Dir("assets/js"))))
 	http.Handle("/css/", http.StripPrefix("/css/", http.FileServer(http.Dir("assets/css"))))
 	http.Handle("/img/", http.StripPrefix("/img/", http.FileServer(http.Dir("assets/img"))))
 
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	<-stopped
 }
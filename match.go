@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/githubnemo/wikirace-serv/wikis"
+)
+
+// Points awarded for the placements in a round. The winner gets the
+// first entry, the second place the second entry and so on. Players
+// placed lower than the table is long as well as players that did not
+// finish get no points.
+var DefaultPlacementPoints = []int{10, 7, 5, 3, 2, 1}
+
+// Points of a player in the match scoreboard.
+type Score struct {
+	Rank   int
+	Name   string
+	Points int
+}
+
+// Points that were awarded in a single round.
+type RoundResult struct {
+	// Hash of the game of the round
+	Game string
+
+	// Points per player name
+	Points map[string]int
+}
+
+// A match groups several games (rounds) played by the same players.
+// Players are awarded points for their placement in each round and
+// the points sum up to the score of the match.
+type Match struct {
+	// Cache for the match hash
+	hash string
+
+	// Name of the player who initiated the match
+	Host string
+
+	// All players that took part in at least one round.
+	Players []string
+
+	// The wiki that is used for all rounds
+	Wiki *wikis.Wiki
+
+	// Number of rounds to play
+	NumRounds int
+
+	// Hashes of the games played so far. The last one is the current round.
+	Rounds []string
+
+	// Points awarded in the finished rounds
+	Results []RoundResult
+
+	// Points per placement, see DefaultPlacementPoints.
+	PlacementPoints []int
+
+	lock sync.RWMutex
+
+	// Called every time changes that are worth saving to disk are made
+	saveHandler func(*Match)
+}
+
+// Usually not called directly, see GameStore.NewMatch.
+func NewMatch(hostingPlayerName string, wiki *wikis.Wiki, rounds int, saveHandler func(*Match)) *Match {
+	return &Match{
+		Host:            hostingPlayerName,
+		Players:         []string{hostingPlayerName},
+		Wiki:            wiki,
+		NumRounds:       rounds,
+		PlacementPoints: DefaultPlacementPoints,
+		saveHandler:     saveHandler,
+	}
+}
+
+// Marshalled under the lock, matches are written in the background
+// while they change.
+func (m *Match) MarshalJSON() ([]byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	type match Match
+
+	return json.Marshal((*match)(m))
+}
+
+func (m *Match) save() {
+	if m.saveHandler != nil {
+		m.saveHandler(m)
+	}
+}
+
+func (m *Match) Hash() string {
+	if len(m.hash) == 0 {
+		m.hash = gameStore.NewGameHash(m.Host)
+	}
+
+	return m.hash
+}
+
+func (m *Match) HasPlayer(name string) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for _, e := range m.Players {
+		if e == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Names of all players taking part in the match.
+func (m *Match) PlayerNames() []string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return append([]string(nil), m.Players...)
+}
+
+// Add the player to the match if not already taking part.
+func (m *Match) AddPlayer(name string) {
+	if m.HasPlayer(name) {
+		return
+	}
+
+	m.lock.Lock()
+	m.Players = append(m.Players, name)
+	m.lock.Unlock()
+
+	m.save()
+}
+
+// Hash of the game of the current round.
+func (m *Match) CurrentRound() string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if len(m.Rounds) == 0 {
+		return ""
+	}
+
+	return m.Rounds[len(m.Rounds)-1]
+}
+
+// Hashes of the games of all rounds played so far.
+func (m *Match) RoundHashes() []string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return append([]string(nil), m.Rounds...)
+}
+
+// Number of the current round, starting at 1.
+func (m *Match) RoundNumber() int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return len(m.Rounds)
+}
+
+// Make the given game the current round of the match.
+func (m *Match) AddRound(game *Game) {
+	m.lock.Lock()
+	m.Rounds = append(m.Rounds, game.Hash())
+	m.lock.Unlock()
+
+	m.save()
+}
+
+func (m *Match) isScored(gameHash string) bool {
+	for _, e := range m.Results {
+		if e.Game == gameHash {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the current round was scored already, meaning that it is over.
+func (m *Match) IsRoundOver() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return len(m.Rounds) > 0 && m.isScored(m.Rounds[len(m.Rounds)-1])
+}
+
+// All rounds were played and scored.
+func (m *Match) IsOver() bool {
+	return m.IsRoundOver() && m.RoundNumber() >= m.NumRounds
+}
+
+// There are rounds left to play and the current round is over.
+func (m *Match) CanStartNextRound() bool {
+	return m.IsRoundOver() && m.RoundNumber() < m.NumRounds
+}
+
+// Award points to the players of the given game based on their
+// placement. Tied players get the points of their shared rank.
+// Rounds are only scored once, scoring a round again has no effect.
+func (m *Match) ScoreRound(game *Game) error {
+	m.lock.Lock()
+
+	if m.isScored(game.Hash()) {
+		m.lock.Unlock()
+		return nil
+	}
+
+	found := false
+	for _, e := range m.Rounds {
+		found = found || e == game.Hash()
+	}
+
+	if !found {
+		m.lock.Unlock()
+		return fmt.Errorf("Game %s is not a round of match %s.", game.Hash(), m.Hash())
+	}
+
+	points := make(map[string]int)
+
+	for _, s := range game.Standings() {
+		if s.Status == StatusFinished && s.Rank <= len(m.PlacementPoints) {
+			points[s.Name] = m.PlacementPoints[s.Rank-1]
+		} else {
+			points[s.Name] = 0
+		}
+	}
+
+	m.Results = append(m.Results, RoundResult{game.Hash(), points})
+
+	m.lock.Unlock()
+
+	m.save()
+
+	return nil
+}
+
+// Cumulative points of all players, ordered by points.
+func (m *Match) Scoreboard() []Score {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	scores := make([]Score, len(m.Players))
+
+	for i, name := range m.Players {
+		scores[i].Name = name
+
+		for _, r := range m.Results {
+			scores[i].Points += r.Points[name]
+		}
+	}
+
+	sort.Sort(sortableScores(scores))
+
+	for i := range scores {
+		if i > 0 && scores[i].Points == scores[i-1].Points {
+			scores[i].Rank = scores[i-1].Rank
+		} else {
+			scores[i].Rank = i + 1
+		}
+	}
+
+	return scores
+}
+
+type sortableScores []Score
+
+func (s sortableScores) Len() int      { return len(s) }
+func (s sortableScores) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s sortableScores) Less(i, j int) bool {
+	if s[i].Points != s[j].Points {
+		return s[i].Points > s[j].Points
+	}
+	return s[i].Name < s[j].Name
+}
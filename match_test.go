@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMatchScoreboard(t *testing.T) {
+	match := NewMatch("player 1", nil, 2, nil)
+	match.hash = "match"
+	match.AddPlayer("player 2")
+
+	game := simpleTwoPlayerGame()
+	game.hash = "round 1"
+	match.AddRound(game)
+
+	if match.CanStartNextRound() {
+		t.Errorf("the first round is not over yet, no next round expected")
+	}
+
+	game.GetPlayer("player 1").Visited("other page")
+	game.GetPlayer("player 2").Visited(game.Goal)
+
+	if err := match.ScoreRound(game); err != nil {
+		t.Fatal(err)
+	}
+
+	// Scoring twice must not award points twice
+	if err := match.ScoreRound(game); err != nil {
+		t.Fatal(err)
+	}
+
+	scores := match.Scoreboard()
+
+	if scores[0].Name != "player 2" || scores[0].Points != DefaultPlacementPoints[0] {
+		t.Errorf("expected player 2 to lead with %d points, got %#v", DefaultPlacementPoints[0], scores)
+	}
+
+	if scores[1].Name != "player 1" || scores[1].Points != 0 {
+		t.Errorf("expected player 1 without points, got %#v", scores)
+	}
+
+	if !match.CanStartNextRound() {
+		t.Errorf("the first round is over, expected a next round")
+	}
+}
+
+func TestMatchDoesNotScoreForeignGames(t *testing.T) {
+	match := NewMatch("player 1", nil, 2, nil)
+	match.hash = "match"
+
+	game := simpleTwoPlayerGame()
+	game.hash = "not a round"
+
+	if err := match.ScoreRound(game); err == nil {
+		t.Errorf("expected an error when scoring a game that is not a round")
+	}
+}
+
+// Ending a round is enough to score it, nobody has to win.
+func TestRoundWithoutWinnerIsScored(t *testing.T) {
+	defer func(old *GameStore) { gameStore = old }(gameStore)
+
+	gameStore = NewGameStore(NewMemoryStore(), NewMemoryStore())
+
+	game := simpleTwoPlayerGame()
+	match := gameStore.NewMatch("player 1", game.Wiki, 2)
+	match.AddPlayer("player 2")
+
+	game.Match = match.Hash()
+
+	if err := gameStore.PutGame(game); err != nil {
+		t.Fatal(err)
+	}
+
+	match.AddRound(game)
+
+	scoreRoundIfOver(game)
+
+	if match.IsRoundOver() {
+		t.Fatal("Running round was scored.")
+	}
+
+	game.End()
+
+	scoreRoundIfOver(game)
+
+	if game.GetWinner() != nil {
+		t.Errorf("Expected no winner, got %#v.", game.GetWinner())
+	}
+
+	if !match.CanStartNextRound() {
+		t.Error("Ended round was not scored.")
+	}
+
+	for _, score := range match.Scoreboard() {
+		if score.Points != 0 {
+			t.Errorf("Expected no points without a finished player, got %#v.", score)
+		}
+	}
+}
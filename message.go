@@ -7,6 +7,15 @@ const (
 	finish
 	gameover
 	fatalstuff
+	nextround
+	rematch
+	checkpoint
+	hint
+	kick
+	hostchange
+	lock
+	gameend
+	restart
 )
 
 type GameMessage interface {
@@ -46,17 +55,82 @@ type VisitMessage struct {
 
 type FinishMessage struct {
 	*BaseGameMessage
-	Visits int
+	Visits        int
+	Standings     Standings
+	TeamStandings TeamStandings
 }
 
 type GameOverMessage struct {
 	*BaseGameMessage
+	Standings     Standings
+	TeamStandings TeamStandings
 }
 
 type FatalStuffMessage struct {
 	*BaseGameMessage
 }
 
+type RematchMessage struct {
+	*BaseGameMessage
+
+	// Hash of the game that was rematched and of the rematch
+	Previous string
+	Game     string
+}
+
+type CheckpointMessage struct {
+	*BaseGameMessage
+	Player *Player
+
+	// Number of checkpoints the player passed and the total number
+	Passed int
+	Total  int
+}
+
+// Tells the other players that someone used a hint. The hint itself
+// is only sent to the player who asked for it.
+type HintMessage struct {
+	*BaseGameMessage
+	Kind    string
+	Hints   int
+	Penalty int
+}
+
+type NextRoundMessage struct {
+	*BaseGameMessage
+	Match string
+	Round int
+}
+
+// Sent by the host to moderate the game. The sending player is
+// always the host at the time the action was taken.
+type KickMessage struct {
+	*BaseGameMessage
+	Kicked string
+}
+
+type HostChangeMessage struct {
+	*BaseGameMessage
+	Host string
+}
+
+type LockMessage struct {
+	*BaseGameMessage
+	Locked bool
+}
+
+type GameEndMessage struct {
+	*BaseGameMessage
+	Winner        string
+	Standings     Standings
+	TeamStandings TeamStandings
+}
+
+// Sent to every client before the server shuts down.
+type RestartMessage struct {
+	*BaseGameMessage
+}
+
 func createMessage(typeNum int, playername, message string) *BaseGameMessage {
 	return &BaseGameMessage{playername, message, typeNum}
 }
@@ -69,7 +143,7 @@ func NewLeaveMessage(session *GameSession) LeaveMessage {
 	return LeaveMessage{createMessage(leave, session.PlayerName(), session.PlayerName())}
 }
 
-func NewFinishMessage(session *GameSession) FinishMessage {
+func NewFinishMessage(session *GameSession, standings Standings, teamStandings TeamStandings) FinishMessage {
 	player, err := PlayerFromSession(session)
 
 	if err != nil {
@@ -82,6 +156,8 @@ func NewFinishMessage(session *GameSession) FinishMessage {
 	return FinishMessage{
 		createMessage(finish, player.Name, player.Name),
 		len(player.Path),
+		standings,
+		teamStandings,
 	}
 }
 
@@ -92,6 +168,84 @@ func NewVisitMessage(session *GameSession, page string, player *Player) VisitMes
 	}
 }
 
-func NewGameOverMessage(session *GameSession) GameOverMessage {
-	return GameOverMessage{createMessage(gameover, session.PlayerName(), session.PlayerName())}
+func NewGameOverMessage(session *GameSession, standings Standings, teamStandings TeamStandings) GameOverMessage {
+	return GameOverMessage{
+		createMessage(gameover, session.PlayerName(), session.PlayerName()),
+		standings,
+		teamStandings,
+	}
+}
+
+func NewNextRoundMessage(session *GameSession, match *Match) NextRoundMessage {
+	return NextRoundMessage{
+		createMessage(nextround, session.PlayerName(), "next round"),
+		match.Hash(),
+		match.RoundNumber(),
+	}
+}
+
+func NewRematchMessage(session *GameSession, previous, game *Game) RematchMessage {
+	return RematchMessage{
+		createMessage(rematch, session.PlayerName(), "rematch"),
+		previous.Hash(),
+		game.Hash(),
+	}
+}
+
+func NewCheckpointMessage(session *GameSession, player *Player, page string, total int) CheckpointMessage {
+	return CheckpointMessage{
+		createMessage(checkpoint, session.PlayerName(), page),
+		player,
+		len(player.Checkpoints),
+		total,
+	}
+}
+
+func NewHintMessage(session *GameSession, player *Player, kind string, penalty int) HintMessage {
+	return HintMessage{
+		createMessage(hint, session.PlayerName(), kind),
+		kind,
+		len(player.Hints),
+		len(player.Hints) * penalty,
+	}
+}
+
+func NewKickMessage(session *GameSession, kicked string) KickMessage {
+	return KickMessage{
+		createMessage(kick, session.PlayerName(), kicked),
+		kicked,
+	}
+}
+
+func NewHostChangeMessage(session *GameSession, host string) HostChangeMessage {
+	return HostChangeMessage{
+		createMessage(hostchange, session.PlayerName(), host),
+		host,
+	}
+}
+
+func NewLockMessage(session *GameSession, locked bool) LockMessage {
+	return LockMessage{
+		createMessage(lock, session.PlayerName(), "lock"),
+		locked,
+	}
+}
+
+func NewGameEndMessage(session *GameSession, game *Game) GameEndMessage {
+	winner := ""
+
+	if p := game.GetWinner(); p != nil {
+		winner = p.Name
+	}
+
+	return GameEndMessage{
+		createMessage(gameend, session.PlayerName(), "game ended"),
+		winner,
+		game.Standings(),
+		game.TeamStandings(),
+	}
+}
+
+func NewRestartMessage() RestartMessage {
+	return RestartMessage{createMessage(restart, "", "server restarting")}
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Rules for player names. Read from config/name_rules if present, see
+// ReadNameRules.
+type NameRules struct {
+	MinLength int
+	MaxLength int
+
+	// Regular expression every name has to match completely. If empty,
+	// names may consist of letters, digits, spaces and -_.'
+	Pattern string
+
+	// Names nobody may use, compared like confusable names.
+	Reserved []string
+
+	// Words that may not be part of a name, compared like confusable names.
+	Profanity []string
+
+	compiled *regexp.Regexp
+}
+
+var DefaultNameRules = NameRules{
+	MinLength: 1,
+	MaxLength: 24,
+	Reserved:  []string{"admin", "host", "server", "system", "nobody"},
+}
+
+var (
+	// Rules used when validating names. Read in main() and on reload,
+	// see ValidateName and SetNameRules.
+	nameRules = DefaultNameRules
+
+	// Lock for nameRules, they are replaced while names are validated.
+	nameRulesLock sync.RWMutex
+)
+
+// Validate the name against the current name rules, see
+// NameRules.Validate.
+func ValidateName(name string) (string, error) {
+	nameRulesLock.RLock()
+	defer nameRulesLock.RUnlock()
+
+	return nameRules.Validate(name)
+}
+
+// Replace the rules used by ValidateName.
+func SetNameRules(rules NameRules) {
+	nameRulesLock.Lock()
+	defer nameRulesLock.Unlock()
+
+	nameRules = rules
+}
+
+// Read the name rules from the JSON file at path. Unset fields keep
+// their defaults. A missing file is no error.
+func ReadNameRules(path string) (NameRules, error) {
+	rules := DefaultNameRules
+
+	file, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return rules, rules.compile()
+	} else if err != nil {
+		return rules, err
+	}
+
+	if err := json.Unmarshal(file, &rules); err != nil {
+		return rules, err
+	}
+
+	return rules, rules.compile()
+}
+
+func (r *NameRules) compile() (err error) {
+	if len(r.Pattern) > 0 {
+		r.compiled, err = regexp.Compile("^(?:" + r.Pattern + ")$")
+	}
+	return
+}
+
+func isAllowedNameRune(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || strings.ContainsRune(" -_.'", c)
+}
+
+// Clean up the name and check it against the rules. Returns the cleaned
+// up name, which is the name to use, or a user friendly error.
+func (r *NameRules) Validate(name string) (string, error) {
+	// Collapse and trim white space so that "a  b" and "a b " are "a b".
+	name = strings.Join(strings.Fields(name), " ")
+
+	if n := utf8.RuneCountInString(name); n < r.MinLength || n > r.MaxLength {
+		return name, ErrNameLength(r.MinLength, r.MaxLength)
+	}
+
+	if r.compiled != nil {
+		if !r.compiled.MatchString(name) {
+			return name, ErrNameCharacters(name)
+		}
+	} else if strings.IndexFunc(name, func(c rune) bool { return !isAllowedNameRune(c) }) >= 0 {
+		return name, ErrNameCharacters(name)
+	}
+
+	skeleton := nameSkeleton(name)
+
+	for _, reserved := range r.Reserved {
+		if skeleton == nameSkeleton(reserved) {
+			return name, ErrNameReserved(name)
+		}
+	}
+
+	for _, word := range r.Profanity {
+		if w := nameSkeleton(word); len(w) > 0 && strings.Contains(skeleton, w) {
+			return name, ErrNameProfane(name)
+		}
+	}
+
+	return name, nil
+}
+
+// Characters that look like other, more common characters. Mostly
+// Cyrillic and Greek letters that look like Latin ones and digits that
+// look like letters.
+var confusables = map[rune]rune{
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'к': 'k', 'м': 'm', 'н': 'h',
+	'о': 'o', 'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'і': 'i',
+	'ј': 'j', 'ѕ': 's', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w',
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v',
+	'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x',
+	'0': 'o', '1': 'l', '3': 'e', '4': 'a', '5': 's', '7': 't', 'i': 'l', '|': 'l',
+	'ı': 'l', 'ℓ': 'l',
+}
+
+// Reduce the name to a form in which names that look alike are equal:
+// lower case, without separators and with confusable characters replaced.
+func nameSkeleton(name string) string {
+	var b strings.Builder
+
+	for _, c := range strings.ToLower(name) {
+		if strings.ContainsRune(" -_.'", c) || unicode.IsMark(c) {
+			continue
+		}
+
+		if r, ok := confusables[c]; ok {
+			c = r
+		}
+
+		b.WriteRune(c)
+	}
+
+	// "rn" looks like "m" in many fonts.
+	return strings.Replace(b.String(), "rn", "m", -1)
+}
+
+// Whether both names look alike, see nameSkeleton.
+func confusableNames(a, b string) bool {
+	return nameSkeleton(a) == nameSkeleton(b)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSetNameRules(t *testing.T) {
+	defer SetNameRules(DefaultNameRules)
+
+	rules := DefaultNameRules
+	rules.MaxLength = 3
+
+	done := make(chan struct{})
+
+	// Names are validated while the rules are replaced.
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 100; i++ {
+			ValidateName("player")
+		}
+	}()
+
+	SetNameRules(rules)
+	<-done
+
+	if _, err := ValidateName("player"); err == nil {
+		t.Error("New rules are not used.")
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	rules := DefaultNameRules
+	rules.Profanity = []string{"darn"}
+
+	valid := map[string]string{
+		"  player   one ": "player one",
+		"Zoë":             "Zoë",
+		"O'Brien-2":       "O'Brien-2",
+	}
+
+	for name, expected := range valid {
+		if cleaned, err := rules.Validate(name); err != nil || cleaned != expected {
+			t.Errorf("%q should be valid as %q, got %q, %v", name, expected, cleaned, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		strings.Repeat("a", 25),
+		"<script>",
+		"Admin",
+		"аdmin", // Cyrillic a
+		"D4rn it",
+		"DARN",
+	}
+
+	for _, name := range invalid {
+		if _, err := rules.Validate(name); err == nil {
+			t.Errorf("%q should be invalid", name)
+		}
+	}
+}
+
+func TestConfusableNamesCanNotJoin(t *testing.T) {
+	game := simpleTwoPlayerGame()
+
+	// Cyrillic "р" and "у" look like Latin "p" and "y".
+	if err := game.CanJoin("рlауer 1", JoinCredentials{}); err == nil {
+		t.Errorf("name that looks like player 1 should be rejected")
+	}
+
+	if err := game.CanJoin("Player_2", JoinCredentials{}); err == nil {
+		t.Errorf("name that looks like player 2 should be rejected")
+	}
+}
+
+func TestMaxPlayers(t *testing.T) {
+	game := simpleTwoPlayerGame()
+	game.MaxPlayers = 2
+
+	if err := game.CanJoin("player 3", JoinCredentials{}); err == nil {
+		t.Errorf("game with two players and a limit of two should be full")
+	}
+
+	game.GetPlayer("player 2").Kicked = true
+
+	if err := game.CanJoin("player 3", JoinCredentials{}); err != nil {
+		t.Errorf("kicked players should not count: %s", err)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Writes changed games to the store in the background. Games are marked
+// dirty on every change and written at most maxDelay later, so that a
+// burst of changes to a game results in a single write. Journal events
+// and other values, like matches, are collected the same way and written
+// with the next flush.
+type Persister struct {
+	put      func(*Game) error
+	maxDelay time.Duration
+
+	// Dirty games by hash
+	dirty map[string]*Game
+
+	// Journal events that were not written yet, by game hash
+	events map[string]*pendingEvents
+
+	// Dirty values other than games by store key, see MarkValueDirty.
+	values map[string]interface{}
+
+	// Keys that are being written by Flush. They count as dirty until
+	// they are written.
+	flushing map[string]int
+
+	// Lock for dirty, events, values and flushing
+	lock sync.Mutex
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+
+	// Called with the key of every game or value that could not be
+	// written. Games that failed for another reason than a version
+	// conflict are retried with the next flush, values always.
+	OnError func(key string, err error)
+
+	// Writes the journal events of the game collected since the last
+	// flush, in order, see AppendEvent. Events that could not be written
+	// are passed to OnError and retried with the next flush.
+	PutEvents func(game *Game, events []GameEvent) error
+
+	// Writes a value under its key, see MarkValueDirty.
+	PutValue func(key string, v interface{}) error
+}
+
+type pendingEvents struct {
+	game   *Game
+	events []GameEvent
+}
+
+func NewPersister(put func(*Game) error, maxDelay time.Duration) *Persister {
+	return &Persister{
+		put:      put,
+		maxDelay: maxDelay,
+		dirty:    make(map[string]*Game),
+		events:   make(map[string]*pendingEvents),
+		values:   make(map[string]interface{}),
+		flushing: make(map[string]int),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		OnError: func(key string, err error) {
+			log.Printf("Error writing %s: %s\n", key, err)
+		},
+	}
+}
+
+// Schedule the game to be written.
+func (p *Persister) MarkDirty(game *Game) {
+	p.lock.Lock()
+	p.dirty[game.Hash()] = game
+	p.lock.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Schedule the value to be written under the key. The value has to be
+// safe to marshal while it is changed, see Match.MarshalJSON.
+func (p *Persister) MarkValueDirty(key string, v interface{}) {
+	p.lock.Lock()
+	p.values[key] = v
+	p.lock.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Schedule the journal event of the game to be written. Events of a
+// game are written in the order they were appended.
+func (p *Persister) AppendEvent(game *Game, e GameEvent) {
+	p.lock.Lock()
+	p.appendEvents(game, []GameEvent{e})
+	p.lock.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Has to be called with the lock held.
+func (p *Persister) appendEvents(game *Game, events []GameEvent) {
+	pending, ok := p.events[game.Hash()]
+
+	if !ok {
+		pending = &pendingEvents{game: game}
+		p.events[game.Hash()] = pending
+	}
+
+	pending.events = append(pending.events, events...)
+}
+
+// Whether the game with the hash, events of it or the value with the
+// key are waiting to be written.
+func (p *Persister) IsDirty(key string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	_, dirty := p.dirty[key]
+	_, journaling := p.events[key]
+	_, value := p.values[key]
+
+	return dirty || journaling || value || p.flushing[key] > 0
+}
+
+// Write all journal events, dirty games and values now. Returns the
+// first error, all errors are passed to OnError.
+func (p *Persister) Flush() error {
+	p.lock.Lock()
+	games := p.dirty
+	p.dirty = make(map[string]*Game)
+	events := p.events
+	p.events = make(map[string]*pendingEvents)
+	values := p.values
+	p.values = make(map[string]interface{})
+	keys := flushedKeys(games, events, values)
+	p.markFlushing(keys, 1)
+	p.lock.Unlock()
+
+	defer func() {
+		p.lock.Lock()
+		p.markFlushing(keys, -1)
+		p.lock.Unlock()
+	}()
+
+	var first error
+
+	for hash, pending := range events {
+		err := p.PutEvents(pending.game, pending.events)
+
+		if err == nil {
+			continue
+		}
+
+		if first == nil {
+			first = err
+		}
+
+		p.OnError(hash, err)
+
+		// They are retried before the events appended since.
+		p.lock.Lock()
+		rest := p.events[hash]
+		delete(p.events, hash)
+		p.appendEvents(pending.game, pending.events)
+		if rest != nil {
+			p.appendEvents(pending.game, rest.events)
+		}
+		p.lock.Unlock()
+	}
+
+	for hash, game := range games {
+		err := p.put(game)
+
+		if err == nil {
+			continue
+		}
+
+		if first == nil {
+			first = err
+		}
+
+		p.OnError(hash, err)
+
+		// A stale game will never be written, everything else is retried.
+		if _, ok := err.(*VersionConflictError); !ok {
+			p.lock.Lock()
+			if _, ok := p.dirty[hash]; !ok {
+				p.dirty[hash] = game
+			}
+			p.lock.Unlock()
+		}
+	}
+
+	for key, v := range values {
+		err := p.PutValue(key, v)
+
+		if err == nil {
+			continue
+		}
+
+		if first == nil {
+			first = err
+		}
+
+		p.OnError(key, err)
+
+		p.lock.Lock()
+		if _, ok := p.values[key]; !ok {
+			p.values[key] = v
+		}
+		p.lock.Unlock()
+	}
+
+	return first
+}
+
+func flushedKeys(games map[string]*Game, events map[string]*pendingEvents, values map[string]interface{}) []string {
+	var keys []string
+
+	for hash := range games {
+		keys = append(keys, hash)
+	}
+
+	for hash := range events {
+		keys = append(keys, hash)
+	}
+
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// Has to be called with the lock held.
+func (p *Persister) markFlushing(keys []string, delta int) {
+	for _, key := range keys {
+		if p.flushing[key] += delta; p.flushing[key] == 0 {
+			delete(p.flushing, key)
+		}
+	}
+}
+
+// Flush dirty games, journal events and values at most maxDelay after
+// they were marked until Stop is called.
+func (p *Persister) Run() {
+	defer close(p.done)
+
+	for {
+		select {
+		case <-p.wake:
+		case <-p.stop:
+			p.Flush()
+			return
+		}
+
+		select {
+		case <-time.After(p.maxDelay):
+		case <-p.stop:
+			p.Flush()
+			return
+		}
+
+		p.Flush()
+	}
+}
+
+// Stop Run after writing the remaining dirty games. Run has to be
+// running.
+func (p *Persister) Stop() {
+	close(p.stop)
+	<-p.done
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/githubnemo/wikirace-serv/wikis"
+)
+
+func TestPersisterCoalescesWrites(t *testing.T) {
+	var lock sync.Mutex
+	writes := make(map[string]int)
+
+	p := NewPersister(func(game *Game) error {
+		lock.Lock()
+		defer lock.Unlock()
+		writes[game.Hash()]++
+		return nil
+	}, time.Hour)
+
+	go p.Run()
+
+	game := simpleTwoPlayerGame()
+	game.hash = "game"
+
+	for i := 0; i < 10; i++ {
+		p.MarkDirty(game)
+	}
+
+	if !p.IsDirty("game") {
+		t.Fatal("Game is not dirty after change.")
+	}
+
+	p.Stop()
+
+	if writes["game"] != 1 {
+		t.Errorf("Expected one write on stop, got %d.", writes["game"])
+	}
+
+	if p.IsDirty("game") {
+		t.Error("Game is still dirty after stop.")
+	}
+}
+
+// A game counts as dirty until it is written, not only until the flush
+// picked it up.
+func TestPersisterGameIsDirtyWhileWritten(t *testing.T) {
+	writing, written := make(chan struct{}), make(chan struct{})
+
+	p := NewPersister(func(game *Game) error {
+		close(writing)
+		<-written
+		return nil
+	}, time.Hour)
+
+	game := simpleTwoPlayerGame()
+	game.hash = "game"
+
+	p.MarkDirty(game)
+
+	flushed := make(chan error)
+
+	go func() {
+		flushed <- p.Flush()
+	}()
+
+	<-writing
+
+	if !p.IsDirty("game") {
+		t.Error("Game is not dirty while it is written.")
+	}
+
+	close(written)
+
+	if err := <-flushed; err != nil {
+		t.Fatal(err)
+	}
+
+	if p.IsDirty("game") {
+		t.Error("Game is still dirty after it was written.")
+	}
+}
+
+func TestPersisterReportsAndRetriesErrors(t *testing.T) {
+	failing := errors.New("disk full")
+	err := failing
+
+	p := NewPersister(func(game *Game) error {
+		return err
+	}, time.Hour)
+
+	var reported []error
+	p.OnError = func(key string, err error) {
+		reported = append(reported, err)
+	}
+
+	game := simpleTwoPlayerGame()
+	game.hash = "game"
+
+	p.MarkDirty(game)
+
+	if p.Flush() != failing || len(reported) != 1 {
+		t.Fatalf("Error was not reported: %v", reported)
+	}
+
+	if !p.IsDirty("game") {
+		t.Fatal("Failed game is not retried.")
+	}
+
+	err = &VersionConflictError{"game", 1, 2}
+
+	p.Flush()
+
+	if p.IsDirty("game") {
+		t.Error("Stale game is retried.")
+	}
+}
+
+func TestPersisterRetriesJournalInOrder(t *testing.T) {
+	failing := errors.New("disk full")
+
+	var written []int
+
+	p := NewPersister(func(game *Game) error {
+		return nil
+	}, time.Hour)
+
+	// The first flush of the events fails.
+	fail := true
+
+	p.PutEvents = func(game *Game, events []GameEvent) error {
+		if fail {
+			fail = false
+			return failing
+		}
+
+		for _, e := range events {
+			written = append(written, e.Seq)
+		}
+
+		return nil
+	}
+
+	var reported []error
+	p.OnError = func(key string, err error) {
+		reported = append(reported, err)
+	}
+
+	game := simpleTwoPlayerGame()
+	game.hash = "game"
+
+	p.AppendEvent(game, GameEvent{Seq: 1})
+	p.AppendEvent(game, GameEvent{Seq: 2})
+	p.AppendEvent(game, GameEvent{Seq: 3})
+
+	if p.Flush() != failing || len(reported) != 1 {
+		t.Fatalf("Error was not reported: %v", reported)
+	}
+
+	if !p.IsDirty("game") {
+		t.Fatal("Game with unwritten events is not dirty.")
+	}
+
+	p.AppendEvent(game, GameEvent{Seq: 4})
+
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(written) != 4 || written[0] != 1 || written[1] != 2 || written[2] != 3 || written[3] != 4 {
+		t.Errorf("Events were not written in order: %v", written)
+	}
+
+	if p.IsDirty("game") {
+		t.Error("Game is still dirty after all events were written.")
+	}
+}
+
+func TestVisitsAreWrittenBehind(t *testing.T) {
+	store := NewGameStore(NewMemoryStore(), NewMemoryStore())
+	persister := store.WriteBehind(time.Millisecond)
+
+	go persister.Run()
+
+	game := NewGame("player 1", nil, nil)
+	game.hash = "game"
+	game.saveHandler = store.gameSaveHandler
+	game.Visit(game.GetPlayer("player 1"), "somewhere")
+
+	persister.Stop()
+
+	loaded := NewGame("", nil, nil)
+
+	if err := store.GetMarshal(game.Hash(), loaded); err != nil {
+		t.Fatal(err)
+	}
+
+	if path := loaded.GetPlayer("player 1").Path; len(path) != 1 || path[0] != "somewhere" {
+		t.Errorf("Visit was not written: %v", path)
+	}
+}
+
+func TestMatchesAndDailiesAreWrittenBehind(t *testing.T) {
+	defer func(old *GameStore) { gameStore = old }(gameStore)
+
+	gameStore = NewGameStore(NewMemoryStore(), NewMemoryStore())
+	persister := gameStore.WriteBehind(time.Hour)
+
+	go persister.Run()
+
+	match := gameStore.NewMatch("host", nil, 2)
+	match.AddPlayer("guest")
+
+	daily := NewDailyChallenge(&wikis.Wiki{URL: "http://wiki"}, "2006-01-02", gameStore.dailySaveHandler)
+	daily.addAttempt("player", "game")
+
+	if !persister.IsDirty(matchKey(match.Hash())) || !persister.IsDirty(daily.Key()) {
+		t.Error("Changed match and daily challenge are not dirty.")
+	}
+
+	persister.Stop()
+
+	loaded := NewMatch("", nil, 0, nil)
+
+	if err := gameStore.GetMarshal(matchKey(match.Hash()), loaded); err != nil || !loaded.HasPlayer("guest") {
+		t.Errorf("Match was not written: %v", err)
+	}
+
+	if !gameStore.Has(daily.Key()) {
+		t.Error("Daily challenge was not written.")
+	}
+}
+
+// Write errors of matches are reported, handlers don't fail.
+func TestMatchWriteErrorIsReported(t *testing.T) {
+	defer func(old *GameStore) { gameStore = old }(gameStore)
+
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "games.db"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.Close()
+
+	gameStore = NewGameStore(store, NewMemoryStore())
+
+	match := gameStore.NewMatch("host", nil, 2)
+	match.AddPlayer("guest")
+}
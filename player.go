@@ -2,6 +2,9 @@ package main
 
 import (
 	"fmt"
+	"time"
+
+	"github.com/githubnemo/wikirace-serv/wikis"
 )
 
 type Player struct {
@@ -10,10 +13,28 @@ type Player struct {
 	Session  *GameSession `json:"-"`
 	LeftGame bool
 
+	// The host removed the player from the game.
+	Kicked bool
+
+	// Checkpoints passed so far, in the order they were passed.
+	Checkpoints []string
+
+	// Hints the player asked for. Each one adds a penalty to his score.
+	Hints []Hint
+
+	// Name of the team the player races for, empty if the game has no teams.
+	Team string
+
+	// Time the player joined the game and the time of the last
+	// visited page. Used to compute the time the player took.
+	JoinedAt    time.Time
+	LastVisitAt time.Time
+
 	game *Game
 }
 
-// Return the player from the game with the session assigned.
+// Return a copy of the player in the game with the session assigned.
+// The player in the game is only changed through the game.
 func PlayerFromSession(session *GameSession) (*Player, error) {
 	game, err := session.GetGame()
 
@@ -21,12 +42,16 @@ func PlayerFromSession(session *GameSession) (*Player, error) {
 		return nil, err
 	}
 
-	p := game.GetPlayer(session.PlayerName())
+	p := game.PlayerCopy(session.PlayerName())
 
 	if p == nil {
 		return nil, fmt.Errorf("Player %s is not in the game %s.", session.PlayerName(), game.Hash())
 	}
 
+	if p.Kicked {
+		return nil, ErrKicked(p.Name)
+	}
+
 	p.Session = session
 	p.game = game
 
@@ -34,15 +59,65 @@ func PlayerFromSession(session *GameSession) (*Player, error) {
 }
 
 func (p *Player) Visited(page string) {
+	p.visitedAt(page, time.Now())
+}
+
+// Record the visit of the page at the given time. Returns false if the
+// visit was not counted.
+func (p *Player) visitedAt(page string, at time.Time) bool {
 	// Do not account visit when reloading the page.
 	// We have no real reason to count this as a re-visit and in case
 	// of a JS error or some incompatibility in the browser this will
 	// only frustrate.
 	if len(p.Path) > 0 && p.Path[len(p.Path)-1] == page {
-		return
+		return false
 	}
 
 	p.Path = append(p.Path, page)
+	p.LastVisitAt = at
+
+	return true
+}
+
+// Whether the last visited page of the player is the given goal.
+func (p *Player) ReachedGoal(goal string) bool {
+	return len(p.Path) > 0 && wikis.SamePage(p.Path[len(p.Path)-1], goal)
+}
+
+// The player reached the goal after passing all checkpoints.
+func (p *Player) HasFinished(rules RaceRules) bool {
+	return len(p.Checkpoints) >= len(rules.Checkpoints) && p.ReachedGoal(rules.Goal)
+}
+
+func (p *Player) hasCheckpoint(checkpoint string) bool {
+	for _, e := range p.Checkpoints {
+		if wikis.SamePage(e, checkpoint) {
+			return true
+		}
+	}
+	return false
+}
+
+// Record the page as passed checkpoint if it is one of the checkpoints
+// the player still has to pass. If inOrder is set, only the next
+// checkpoint in the list counts. Returns the passed checkpoint.
+func (p *Player) PassCheckpoint(page string, checkpoints []string, inOrder bool) (string, bool) {
+	for _, checkpoint := range checkpoints {
+		if p.hasCheckpoint(checkpoint) {
+			continue
+		}
+
+		if wikis.SamePage(page, checkpoint) {
+			p.Checkpoints = append(p.Checkpoints, checkpoint)
+			return checkpoint, true
+		}
+
+		if inOrder {
+			break
+		}
+	}
+
+	return "", false
 }
 
 func (p *Player) LastVisited() string {
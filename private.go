@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const INVITE_KEY_LENGTH = 32
+
+// Key the invite tokens are signed with. Initialized in main().
+var inviteKey []byte
+
+// What a player can present to join a private game.
+type JoinCredentials struct {
+	Password string
+
+	// Invite token as handed out by the host, see Game.InviteToken.
+	Token string
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// Hash of the password as stored with games that were made private
+// before passwords were hashed with bcrypt. Only used to check them.
+func legacyPasswordHash(salt, password string) string {
+	sum := sha256.Sum256([]byte(salt + password))
+	return hex.EncodeToString(sum[:])
+}
+
+// Make the game private. Players need an invite token or, if the
+// password is not empty, the password to join. Fails for passwords
+// bcrypt can't hash, i.e. longer than 72 bytes.
+func (g *Game) MakePrivate(password string) error {
+	if len(password) > 0 {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+
+		if err != nil {
+			return err
+		}
+
+		g.PasswordSalt = ""
+		g.PasswordHash = string(hash)
+	}
+
+	g.Private = true
+	g.InviteNonce = randomString(16)
+
+	return nil
+}
+
+// Whether the password is the one of the game.
+func (g *Game) checkPassword(password string) bool {
+	// Games that were made private before bcrypt was used.
+	if len(g.PasswordSalt) > 0 {
+		hash := legacyPasswordHash(g.PasswordSalt, password)
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(g.PasswordHash)) == 1
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(g.PasswordHash), []byte(password)) == nil
+}
+
+func (g *Game) HasPassword() bool {
+	return len(g.PasswordHash) > 0
+}
+
+// The token that lets players join the private game without password.
+// Changes when the host rotates it.
+func (g *Game) InviteToken() (token string) {
+	g.Do(func() {
+		token = g.inviteToken()
+	})
+
+	return
+}
+
+func (g *Game) inviteToken() string {
+	mac := hmac.New(sha256.New, inviteKey)
+	mac.Write([]byte(g.Hash() + ":" + g.InviteNonce))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Invalidate the invite token handed out so far.
+func (g *Game) RotateInviteToken() {
+	g.Do(func() {
+		g.change(GameEvent{Type: EventInvite, Data: eventData(randomString(16))})
+	})
+}
+
+// Whether the credentials allow to join the game. Public games can be
+// joined without any.
+func (g *Game) checkCredentials(credentials JoinCredentials) error {
+	if !g.Private {
+		return nil
+	}
+
+	if len(credentials.Token) > 0 {
+		if subtle.ConstantTimeCompare([]byte(credentials.Token), []byte(g.inviteToken())) == 1 {
+			return nil
+		}
+		return ErrInvalidInvite()
+	}
+
+	if g.HasPassword() && len(credentials.Password) > 0 {
+		if g.checkPassword(credentials.Password) {
+			return nil
+		}
+		return ErrWrongPassword()
+	}
+
+	return ErrPrivateGame()
+}
+
+// Whether somebody may watch the game. Private games can only be
+// watched by their players or with the credentials to join them.
+func (g *Game) CanSpectate(playerName string, credentials JoinCredentials) (err error) {
+	g.Do(func() {
+		if len(playerName) > 0 && g.GetPlayer(playerName) != nil {
+			return
+		}
+
+		err = g.checkCredentials(credentials)
+	})
+
+	return
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrivateGame(t *testing.T) {
+	inviteKey = []byte("test key")
+
+	game := simpleTwoPlayerGame()
+	game.hash = "private"
+
+	if err := game.CanJoin("player 3", JoinCredentials{}); err != nil {
+		t.Errorf("public games need no credentials: %s", err)
+	}
+
+	if err := game.MakePrivate("secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(game.PasswordHash, "secret") || len(game.PasswordSalt) > 0 {
+		t.Errorf("password is not hashed with bcrypt: %q", game.PasswordHash)
+	}
+
+	if err := game.CanJoin("player 3", JoinCredentials{}); err == nil {
+		t.Errorf("private game joined without credentials")
+	}
+
+	if err := game.CanJoin("player 3", JoinCredentials{Password: "wrong"}); err == nil {
+		t.Errorf("private game joined with the wrong password")
+	}
+
+	if err := game.CanJoin("player 3", JoinCredentials{Password: "secret"}); err != nil {
+		t.Errorf("password was not accepted: %s", err)
+	}
+
+	token := game.InviteToken()
+
+	if err := game.CanJoin("player 3", JoinCredentials{Token: token}); err != nil {
+		t.Errorf("invite token was not accepted: %s", err)
+	}
+
+	game.RotateInviteToken()
+
+	if err := game.CanJoin("player 3", JoinCredentials{Token: token}); err == nil {
+		t.Errorf("rotated invite token was still accepted")
+	}
+}
+
+func TestPrivateGameSpectators(t *testing.T) {
+	inviteKey = []byte("test key")
+
+	game := simpleTwoPlayerGame()
+	game.hash = "private"
+
+	if err := game.CanSpectate("", JoinCredentials{}); err != nil {
+		t.Errorf("public games can be watched by anybody: %s", err)
+	}
+
+	game.MakePrivate("secret")
+
+	if err := game.CanSpectate("", JoinCredentials{}); err == nil {
+		t.Errorf("private game watched without credentials")
+	}
+
+	if err := game.CanSpectate("player 3", JoinCredentials{}); err == nil {
+		t.Errorf("private game watched by somebody who is no player")
+	}
+
+	if err := game.CanSpectate("player 2", JoinCredentials{}); err != nil {
+		t.Errorf("player can't watch their own game: %s", err)
+	}
+
+	if err := game.CanSpectate("", JoinCredentials{Password: "secret"}); err != nil {
+		t.Errorf("password was not accepted: %s", err)
+	}
+
+	if err := game.CanSpectate("", JoinCredentials{Token: game.InviteToken()}); err != nil {
+		t.Errorf("invite token was not accepted: %s", err)
+	}
+}
+
+// Games made private before bcrypt was used keep their password.
+func TestLegacyPasswordHash(t *testing.T) {
+	game := simpleTwoPlayerGame()
+	game.Private = true
+	game.PasswordSalt = "salt"
+	game.PasswordHash = legacyPasswordHash("salt", "secret")
+
+	if err := game.CanJoin("player 3", JoinCredentials{Password: "secret"}); err != nil {
+		t.Errorf("legacy password was not accepted: %s", err)
+	}
+
+	if err := game.CanJoin("player 3", JoinCredentials{Password: "wrong"}); err == nil {
+		t.Errorf("private game joined with the wrong password")
+	}
+}
+
+func TestTooLongPassword(t *testing.T) {
+	game := simpleTwoPlayerGame()
+
+	if err := game.MakePrivate(strings.Repeat("x", 100)); err == nil || game.Private {
+		t.Errorf("password bcrypt can't hash was accepted")
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Where games, matches, daily challenges and journals are persisted.
+// They share the repository with the games, their keys are prefixed,
+// see matchKey, dailyKey and journalKey. The implementation used by the
+// server is *Store with one of its backends.
+type GameRepository interface {
+	// Get and put values marshalled as JSON.
+	GetMarshal(key string, v interface{}) error
+	PutMarshal(key string, v interface{}) error
+
+	Erase(key string) error
+	Has(key string) bool
+	Contains(key string) bool
+
+	// Keys starting with the prefix, all keys if the prefix is empty.
+	Keys(prefix string) ([]string, error)
+
+	// Hashes of the games matching the query.
+	QueryGames(q GameQuery) ([]string, error)
+
+	// Summaries of the games matching the query, ordered by hash.
+	SummarizeGames(q GameQuery) ([]GameSummary, error)
+
+	Close() error
+}
+
+// Whether the key belongs to a game and not to a match, daily challenge
+// or journal event.
+func isGameKey(key string) bool {
+	return !strings.HasPrefix(key, matchKey("")) && !strings.HasPrefix(key, "daily-") && !strings.HasPrefix(key, "journal-")
+}
+
+// Criteria for games. Empty fields match every game.
+type GameQuery struct {
+	// Games the player took part in
+	Player string
+
+	// Games hosted by the player
+	Host string
+
+	// URL of the wiki the games are played on
+	Wiki string
+
+	// Games created in this period, both ends are inclusive
+	Since time.Time
+	Until time.Time
+
+	State GameState
+
+	// Games won by the player
+	Winner string
+
+	// Only games that have a winner
+	HasWinner bool
+}
+
+// Restrict the query to games created on the days from since to until,
+// both given as YYYY-MM-DD in local time. Empty days are not restricted.
+func (q *GameQuery) SetDays(since, until string) (err error) {
+	if len(since) > 0 {
+		if q.Since, err = time.ParseInLocation("2006-01-02", since, time.Local); err != nil {
+			return err
+		}
+	}
+
+	if len(until) > 0 {
+		if q.Until, err = time.ParseInLocation("2006-01-02", until, time.Local); err != nil {
+			return err
+		}
+
+		q.Until = q.Until.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+
+	return nil
+}
+
+func (q GameQuery) Matches(game *Game) bool {
+	if len(q.Player) > 0 && !game.HasPlayer(q.Player) {
+		return false
+	}
+
+	if len(q.Host) > 0 && game.Host != q.Host {
+		return false
+	}
+
+	if len(q.Wiki) > 0 && (game.Wiki == nil || game.Wiki.URL != q.Wiki) {
+		return false
+	}
+
+	if !q.Since.IsZero() && game.CreatedAt.Before(q.Since) {
+		return false
+	}
+
+	if !q.Until.IsZero() && game.CreatedAt.After(q.Until) {
+		return false
+	}
+
+	winner := ""
+
+	if w := game.GetWinner(); w != nil {
+		winner = w.Name
+	}
+
+	if len(q.Winner) > 0 && winner != q.Winner || q.HasWinner && len(winner) == 0 {
+		return false
+	}
+
+	return len(q.State) == 0 || game.State() == q.State
+}
+
+// What is known about a game without loading it, see SummarizeGames.
+type GameSummary struct {
+	Hash      string
+	State     GameState
+	Host      string
+	Wiki      string
+	Players   []string
+	Winner    string `json:",omitempty"`
+	CreatedAt time.Time
+
+	// Last change of the game, see ExpiryPolicy.
+	UpdatedAt time.Time
+
+	// Set for games in the archive
+	Archived bool `json:",omitempty"`
+
+	// When the game is over if it is not changed before, because the
+	// players racing run out of time. See StateAt.
+	OverAt time.Time `json:"-"`
+
+	// Private games are not listed publicly, see apiGamesHandler.
+	Private bool `json:"-"`
+}
+
+// State of the game at the given time. Summaries of running games are
+// not updated when the players run out of time.
+func (s GameSummary) StateAt(now time.Time) GameState {
+	if s.State == GameRunning && !s.OverAt.IsZero() && !now.Before(s.OverAt) {
+		return GameOver
+	}
+
+	return s.State
+}
+
+// Summary of the game as it is now. Games are summarized when they are
+// written, which is a command of the game, see Do.
+func NewGameSummary(hash string, game *Game) GameSummary {
+	now := time.Now()
+
+	s := GameSummary{
+		Hash:      hash,
+		State:     game.state(),
+		OverAt:    game.overAt(now),
+		Host:      game.Host,
+		CreatedAt: game.CreatedAt,
+		UpdatedAt: game.UpdatedAt,
+		Private:   game.Private,
+	}
+
+	if game.Wiki != nil {
+		s.Wiki = game.Wiki.URL
+	}
+
+	if len(game.Winner) > 0 && game.GetPlayer(game.Winner) != nil {
+		s.Winner = game.Winner
+	}
+
+	for _, p := range game.Players {
+		s.Players = append(s.Players, p.Name)
+	}
+
+	return s
+}
+
+// Load every game and check it against the query.
+func (g *Store) QueryGames(q GameQuery) ([]string, error) {
+	summaries, err := g.SummarizeGames(q)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var hashes []string
+
+	for _, s := range summaries {
+		hashes = append(hashes, s.Hash)
+	}
+
+	return hashes, nil
+}
+
+// Load every game and check it against the query.
+func (g *Store) SummarizeGames(q GameQuery) ([]GameSummary, error) {
+	keys, err := g.Keys("")
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(keys)
+
+	var summaries []GameSummary
+
+	for _, key := range keys {
+		if !isGameKey(key) {
+			continue
+		}
+
+		game, summary, err := readStoredGame(g, key)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if q.Matches(game) {
+			summaries = append(summaries, summary)
+		}
+	}
+
+	return summaries, nil
+}
+
+// Read the game stored under the key with its summary. The game may be
+// archived, see ArchivedGame.
+func readStoredGame(repository GameRepository, key string) (*Game, GameSummary, error) {
+	var raw json.RawMessage
+
+	if err := repository.GetMarshal(key, &raw); err != nil {
+		return nil, GameSummary{}, err
+	}
+
+	var archived struct {
+		ArchivedAt time.Time
+		Game       json.RawMessage
+	}
+
+	if err := json.Unmarshal(raw, &archived); err != nil {
+		return nil, GameSummary{}, err
+	}
+
+	if !archived.ArchivedAt.IsZero() {
+		raw = archived.Game
+	}
+
+	game := NewGame("", nil, nil)
+
+	if err := json.Unmarshal(raw, game); err != nil {
+		return nil, GameSummary{}, err
+	}
+
+	summary := NewGameSummary(key, game)
+	summary.Archived = !archived.ArchivedAt.IsZero()
+
+	return game, summary, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testStores(t *testing.T) map[string]*Store {
+	bolt, err := NewBoltStore(filepath.Join(t.TempDir(), "games.db"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { bolt.Close() })
+
+	return map[string]*Store{
+		"diskv":  NewStore(t.TempDir()),
+		"memory": NewMemoryStore(),
+		"bolt":   bolt,
+	}
+}
+
+func TestRepositoryBackends(t *testing.T) {
+	for name, store := range testStores(t) {
+		running := simpleTwoPlayerGame()
+		running.hash = "running"
+
+		finished := simpleTwoPlayerGame()
+		finished.hash = "finished"
+		finished.Host = "player 2"
+		finished.CreatedAt = time.Now().Add(-48 * time.Hour)
+		finished.GetPlayer("player 2").Visited(finished.Goal)
+		finished.GetPlayer("player 1").LeftGame = true
+
+		for _, game := range []*Game{running, finished} {
+			if err := store.PutMarshal(game.Hash(), game); err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+		}
+
+		store.PutMarshal(matchKey("match"), NewMatch("player 1", nil, 2, nil))
+
+		loaded := NewGame("", nil, nil)
+
+		if err := store.GetMarshal("finished", loaded); err != nil || loaded.Host != "player 2" {
+			t.Errorf("%s: finished game not read back: %v", name, err)
+		}
+
+		if keys, _ := store.Keys("match-"); len(keys) != 1 {
+			t.Errorf("%s: expected one match, got %v", name, keys)
+		}
+
+		queries := map[string]GameQuery{
+			"running":  {State: GameRunning},
+			"finished": {Host: "player 2", Since: time.Now().Add(-72 * time.Hour), Until: time.Now().Add(-24 * time.Hour)},
+		}
+
+		for expected, q := range queries {
+			if hashes, err := store.QueryGames(q); err != nil || len(hashes) != 1 || hashes[0] != expected {
+				t.Errorf("%s: query %#v should find %s, got %v, %v", name, q, expected, hashes, err)
+			}
+		}
+
+		if hashes, _ := store.QueryGames(GameQuery{Player: "player 1"}); len(hashes) != 2 {
+			t.Errorf("%s: player 1 took part in two games, got %v", name, hashes)
+		}
+
+		if err := store.Erase("running"); err != nil || store.Has("running") {
+			t.Errorf("%s: game was not deleted: %v", name, err)
+		}
+	}
+}
+
+func TestCopyStore(t *testing.T) {
+	stores := testStores(t)
+
+	game := simpleTwoPlayerGame()
+	game.hash = "game"
+
+	stores["diskv"].PutMarshal(game.Hash(), game)
+	stores["diskv"].PutMarshal(matchKey("match"), NewMatch("player 1", nil, 2, nil))
+
+	if n, err := stores["diskv"].CopyTo(stores["bolt"]); err != nil || n != 2 {
+		t.Fatalf("expected two copied values, got %d, %v", n, err)
+	}
+
+	if !stores["bolt"].Has("game") || !stores["bolt"].Has(matchKey("match")) {
+		t.Errorf("game and match should have been copied")
+	}
+}
+
+func TestStaleGameIsNotWritten(t *testing.T) {
+	for name, store := range testStores(t) {
+		game := simpleTwoPlayerGame()
+		game.hash = "game"
+
+		if err := store.PutMarshal(game.Hash(), game); err != nil || game.Version != 1 {
+			t.Fatalf("%s: new game not written: %v, version %d", name, err, game.Version)
+		}
+
+		stale := NewGame("", nil, nil)
+		store.GetMarshal(game.Hash(), stale)
+
+		game.GetPlayer("player 1").Visited(game.Goal)
+
+		if err := store.PutMarshal(game.Hash(), game); err != nil || game.Version != 2 {
+			t.Fatalf("%s: game not updated: %v, version %d", name, err, game.Version)
+		}
+
+		err := store.PutMarshal(game.Hash(), stale)
+
+		if _, ok := err.(*VersionConflictError); !ok {
+			t.Fatalf("%s: expected a version conflict, got %v", name, err)
+		}
+
+		if stale.Version != 1 {
+			t.Errorf("%s: version of stale game changed to %d", name, stale.Version)
+		}
+
+		loaded := NewGame("", nil, nil)
+		store.GetMarshal(game.Hash(), loaded)
+
+		if loaded.Version != 2 || !loaded.GetPlayer("player 1").HasFinished(loaded.Rules()) {
+			t.Errorf("%s: stale game overwrote the newer one", name)
+		}
+	}
+}
+
+func TestErasedGameCanBeWrittenAgain(t *testing.T) {
+	for name, store := range testStores(t) {
+		game := simpleTwoPlayerGame()
+		game.hash = "game"
+
+		store.PutMarshal(game.Hash(), game)
+		store.PutMarshal(game.Hash(), game)
+
+		if err := store.Erase(game.Hash()); err != nil {
+			t.Fatal(err)
+		}
+
+		again := simpleTwoPlayerGame()
+
+		if err := store.PutMarshal(game.Hash(), again); err != nil || again.Version != 1 {
+			t.Errorf("%s: new game not written after erase: %v, version %d", name, err, again.Version)
+		}
+	}
+}
+
+// A store used by the server can't be claimed by a command meanwhile.
+// Directories are locked by LockStore, bolt files when they are opened.
+func TestLockStore(t *testing.T) {
+	dir := t.TempDir()
+
+	diskv := "diskv:" + filepath.Join(dir, "games")
+
+	unlock, err := LockStore(diskv)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LockStore(diskv); err != errStoreInUse {
+		t.Errorf("Expected the directory to be in use, got %v", err)
+	}
+
+	unlock()
+
+	if unlock, err := LockStore(diskv); err != nil {
+		t.Errorf("Directory is still locked: %v", err)
+	} else {
+		unlock()
+	}
+
+	bolt := "bolt:" + filepath.Join(dir, "games.db")
+
+	store, err := OpenStore(bolt)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenStore(bolt); err != errStoreInUse {
+		t.Errorf("Expected the bolt file to be in use, got %v", err)
+	}
+
+	store.Close()
+}
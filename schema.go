@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Format of stored games. Whenever a change to Game or Player would
+// break loading older games, increment it and add a migration from the
+// previous version to gameMigrations.
+const GameSchemaVersion = 1
+
+// Changes a stored game, decoded as JSON object, from one schema
+// version to the next.
+type gameMigration func(game map[string]interface{}) error
+
+// Migrations by the schema version they migrate from.
+var gameMigrations = map[int]gameMigration{
+	0: migrateGameFromV0,
+}
+
+// Games stored before the schema version existed. Games from before
+// CreatedAt existed get the time of their last change instead, which
+// is the closest known time.
+func migrateGameFromV0(game map[string]interface{}) error {
+	if created, _ := game["CreatedAt"].(string); len(created) > 0 && created != "0001-01-01T00:00:00Z" {
+		return nil
+	}
+
+	if updated, ok := game["UpdatedAt"]; ok {
+		game["CreatedAt"] = updated
+	}
+
+	return nil
+}
+
+// Bring the stored game to the current schema version. Returns the
+// schema version it was stored with.
+func migrateGame(data []byte) ([]byte, int, error) {
+	var stored struct{ Schema int }
+
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, 0, err
+	}
+
+	if stored.Schema == GameSchemaVersion {
+		return data, stored.Schema, nil
+	}
+
+	if stored.Schema > GameSchemaVersion {
+		return nil, stored.Schema, fmt.Errorf("Game schema %d is newer than the supported schema %d.", stored.Schema, GameSchemaVersion)
+	}
+
+	var game map[string]interface{}
+
+	if err := json.Unmarshal(data, &game); err != nil {
+		return nil, stored.Schema, err
+	}
+
+	for version := stored.Schema; version < GameSchemaVersion; version++ {
+		migrate, ok := gameMigrations[version]
+
+		if !ok {
+			return nil, stored.Schema, fmt.Errorf("No migration from game schema %d.", version)
+		}
+
+		if err := migrate(game); err != nil {
+			return nil, stored.Schema, fmt.Errorf("Migrating game from schema %d: %s", version, err)
+		}
+	}
+
+	game["Schema"] = GameSchemaVersion
+
+	data, err := json.Marshal(game)
+
+	return data, stored.Schema, err
+}
+
+// Game without its methods so that it is decoded the default way.
+type storedGame Game
+
+// Games are migrated to the current schema version when they are loaded.
+func (g *Game) UnmarshalJSON(data []byte) error {
+	data, _, err := migrateGame(data)
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, (*storedGame)(g))
+}
+
+// Outcome of MigrateSchema.
+type SchemaReport struct {
+	// Number of games by the schema version they were stored with
+	Versions map[int]int
+
+	// Games that were or would be migrated
+	Migrated []string
+
+	// Errors by the key of the game that could not be migrated
+	Failed map[string]error
+}
+
+// Migrate every stored game to the current schema version in place.
+// With dryRun nothing is written, the report tells what would be
+// migrated.
+func MigrateSchema(store *Store, dryRun bool) (SchemaReport, error) {
+	report := SchemaReport{
+		Versions: make(map[int]int),
+		Failed:   make(map[string]error),
+	}
+
+	keys, err := store.Keys("")
+
+	if err != nil {
+		return report, err
+	}
+
+	for _, key := range keys {
+		if !isGameKey(key) {
+			continue
+		}
+
+		data, err := store.Read(key)
+
+		if err != nil {
+			report.Failed[key] = err
+			continue
+		}
+
+		data, version, err := migrateGame(data)
+
+		report.Versions[version]++
+
+		if err != nil {
+			report.Failed[key] = err
+			continue
+		}
+
+		if version == GameSchemaVersion {
+			continue
+		}
+
+		report.Migrated = append(report.Migrated, key)
+
+		if dryRun {
+			continue
+		}
+
+		if err := store.Write(key, data); err != nil {
+			report.Failed[key] = err
+		}
+	}
+
+	return report, nil
+}
+
+func (r SchemaReport) String() string {
+	var versions []int
+
+	for version := range r.Versions {
+		versions = append(versions, version)
+	}
+
+	sort.Ints(versions)
+
+	s := ""
+
+	for _, version := range versions {
+		s += fmt.Sprintf("Schema %d: %d games\n", version, r.Versions[version])
+	}
+
+	s += fmt.Sprintf("Migrated to schema %d: %d games\n", GameSchemaVersion, len(r.Migrated))
+
+	for key, err := range r.Failed {
+		s += fmt.Sprintf("Failed %s: %s\n", key, err)
+	}
+
+	return s
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+const gameWithoutSchema = `{
+	"Host": "player 1",
+	"Players": [{"Name": "player 1", "Path": ["start"]}],
+	"Start": "start",
+	"Goal": "goal",
+	"Version": 3,
+	"UpdatedAt": "2020-05-01T12:00:00Z"
+}`
+
+func TestOldGamesAreMigratedOnLoad(t *testing.T) {
+	store := NewMemoryStore()
+	store.Write("old", []byte(gameWithoutSchema))
+
+	game := NewGame("", nil, nil)
+
+	if err := store.GetMarshal("old", game); err != nil {
+		t.Fatal(err)
+	}
+
+	if game.Schema != GameSchemaVersion || game.Version != 3 || game.Host != "player 1" {
+		t.Errorf("Game was not migrated: schema %d, version %d, host %q", game.Schema, game.Version, game.Host)
+	}
+
+	if !game.CreatedAt.Equal(time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("CreatedAt was not taken from UpdatedAt: %s", game.CreatedAt)
+	}
+
+	store.Write("future", []byte(`{"Schema": 1000}`))
+
+	if err := store.GetMarshal("future", NewGame("", nil, nil)); err == nil {
+		t.Error("Game with a newer schema was loaded.")
+	}
+}
+
+func TestMigrateSchema(t *testing.T) {
+	store := NewMemoryStore()
+	store.Write("old", []byte(gameWithoutSchema))
+	store.PutMarshal(matchKey("match"), NewMatch("player 1", nil, 2, nil))
+
+	current := simpleTwoPlayerGame()
+	current.hash = "current"
+	store.PutMarshal("current", current)
+
+	report, err := MigrateSchema(store, true)
+
+	if err != nil || len(report.Migrated) != 1 || report.Versions[0] != 1 || report.Versions[GameSchemaVersion] != 1 {
+		t.Fatalf("Unexpected dry run report: %v %v", report, err)
+	}
+
+	if data, _ := store.Read("old"); string(data) != gameWithoutSchema {
+		t.Fatal("Dry run changed the game.")
+	}
+
+	report, err = MigrateSchema(store, false)
+
+	if err != nil || len(report.Migrated) != 1 || len(report.Failed) != 0 {
+		t.Fatalf("Unexpected report: %v %v", report, err)
+	}
+
+	if report, _ := MigrateSchema(store, true); len(report.Migrated) != 0 {
+		t.Errorf("Games left to migrate: %v", report.Migrated)
+	}
+}
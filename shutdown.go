@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Stop the server without losing anything: no new games are accepted,
+// connected clients are told that the server restarts, open requests
+// may finish until the timeout, expiry stops and the changed games are
+// written before the stores are closed.
+func shutdown(server *http.Server, persister *Persister, timeout time.Duration, stores ...*Store) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	gameStore.RefuseNewGames()
+
+	// Clients that don't pick up the message in time are cut off when
+	// the process exits.
+	notified := make(chan struct{})
+
+	go func() {
+		ClientHandler.Close(NewRestartMessage())
+		close(notified)
+	}()
+
+	select {
+	case <-notified:
+	case <-ctx.Done():
+		log.Println("Not all clients could be told about the shutdown.")
+	}
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Open requests were cut off:", err)
+	}
+
+	// Expiry reads and writes the stores and may load games again.
+	gameStore.StopExpiry()
+
+	persister.Stop()
+
+	for _, store := range stores {
+		if err := store.Close(); err != nil {
+			log.Println("Error closing store:", err)
+		}
+	}
+}
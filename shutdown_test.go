@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/githubnemo/wikirace-serv/wikis"
+	"golang.org/x/net/websocket"
+)
+
+func TestShutdownNotifiesClientsAndWritesGames(t *testing.T) {
+	defer func(old *GameStore) { gameStore = old }(gameStore)
+	defer func(old *GameSessionStore) { session = old }(session)
+	defer func(old *SocketHandler) { ClientHandler = old }(ClientHandler)
+
+	repository := NewMemoryStore()
+	gameStore = NewGameStore(repository, NewMemoryStore())
+	session = NewGameSessionStore()
+	ClientHandler = NewSocketHandler()
+
+	// Nothing is written before the shutdown.
+	persister := gameStore.WriteBehind(time.Hour)
+	go persister.Run()
+
+	game := gameStore.NewGame("host", &wikis.Wiki{})
+	game.Start = "start page"
+	game.Goal = "goal page"
+
+	if err := gameStore.PutGame(game); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/client", websocket.Handler(SockServer))
+
+	server := &http.Server{Handler: mux}
+	serverURL := "http://" + listener.Addr().String()
+
+	go server.Serve(listener)
+
+	cookie, err := sessionCookie("host", game.Hash())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var clients []*websocket.Conn
+
+	for _, query := range []string{"", "?spectate=" + game.Hash()} {
+		ws, err := dialClient(serverURL, query, cookie)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer ws.Close()
+
+		clients = append(clients, ws)
+	}
+
+	waitFor(t, "clients to connect", func() bool {
+		return ClientHandler.clientCount(game.Hash()) == len(clients)
+	})
+
+	game.Visit(game.PlayerCopy("host"), "somewhere")
+
+	shutdown(server, persister, time.Second, repository)
+
+	for i, ws := range clients {
+		restarting := false
+
+		for {
+			var data string
+
+			if err := websocket.Message.Receive(ws, &data); err != nil {
+				break
+			}
+
+			var msg struct{ GameMessage BaseGameMessage }
+
+			if err := json.Unmarshal([]byte(data), &msg); err != nil {
+				t.Fatal(err)
+			}
+
+			restarting = restarting || msg.GameMessage.Type == restart
+		}
+
+		if !restarting {
+			t.Errorf("Client %d was not told about the restart.", i)
+		}
+	}
+
+	if _, err := dialClient(serverURL, "", cookie); err == nil {
+		t.Error("Server still accepts connections.")
+	}
+
+	if err := gameStore.PutGame(gameStore.NewGame("late", &wikis.Wiki{})); err != errShuttingDown {
+		t.Errorf("New game was not refused: %v", err)
+	}
+
+	loaded, err := NewGameStore(repository, NewMemoryStore()).GetGameByHash(game.Hash())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if page := loaded.PlayerCopy("host").LastVisited(); page != "somewhere" {
+		t.Errorf("Visit was not written, last visited page is %q.", page)
+	}
+}
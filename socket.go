@@ -5,14 +5,14 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"sync"
 )
 
 var (
-	JSON          = websocket.JSON                // codec for JSON
-	Message       = websocket.Message             // codec for string, []byte
-	ActiveClients = make(map[ClientConn]struct{}) // map containing clients
+	JSON    = websocket.JSON    // codec for JSON
+	Message = websocket.Message // codec for string, []byte
 
-	ClientHandler = SocketHandler(make(map[*Game]gameClients))
+	ClientHandler = NewSocketHandler()
 )
 
 // Client connection consists of the websocket and the client ip
@@ -21,12 +21,24 @@ type ClientConn struct {
 	clientIP   string
 	inputChan  *chan GameMessage
 	playerName string
+
+	// Spectators receive all messages but are no players.
+	spectator bool
+
+	// Closed when the client is not served anymore.
+	done chan struct{}
 }
 
 func init() {
 	http.Handle("/client", websocket.Handler(SockServer))
 }
 
+func newClientConn(ws *websocket.Conn, playerName string, spectator bool) ClientConn {
+	inputChan := make(chan GameMessage)
+
+	return ClientConn{ws, ws.Request().RemoteAddr, &inputChan, playerName, spectator, make(chan struct{})}
+}
+
 type gameClients map[ClientConn]struct{}
 
 type AddressedGameMessage struct {
@@ -34,37 +46,133 @@ type AddressedGameMessage struct {
 	RecipientName string
 }
 
-type SocketHandler map[*Game]gameClients
+// The clients connected to each game, by game hash. Connections come
+// and go on their own goroutines, so all methods are safe for
+// concurrent use.
+type SocketHandler struct {
+	games map[string]gameClients
+	lock  sync.RWMutex
+
+	// Closed when the server shuts down, see Close.
+	closed chan struct{}
+}
+
+func NewSocketHandler() *SocketHandler {
+	return &SocketHandler{
+		games:  make(map[string]gameClients),
+		closed: make(chan struct{}),
+	}
+}
 
 // TODO: error returned?
-func (handler SocketHandler) Broadcast(game *Game, msg GameMessage) {
-	clients := handler[game]
+func (handler *SocketHandler) Broadcast(hash string, msg GameMessage) {
+	// Sending blocks until the client picks up the message, so the
+	// lock is not held while sending.
+	handler.lock.RLock()
+
+	var clients []ClientConn
+
+	for client := range handler.games[hash] {
+		clients = append(clients, client)
+	}
+
+	handler.lock.RUnlock()
+
+	for _, client := range clients {
+		// The client may be gone since, nobody would pick up the
+		// message then.
+		select {
+		case *client.inputChan <- AddressedGameMessage{msg, client.playerName}:
+		case <-client.done:
+		}
+	}
+}
+
+// Names of the players that are connected to the given game.
+func (handler *SocketHandler) ConnectedPlayers(hash string) []string {
+	handler.lock.RLock()
+	defer handler.lock.RUnlock()
+
+	var names []string
 
-	for client := range clients {
-		*client.inputChan <- AddressedGameMessage{msg, client.playerName}
+	for client := range handler.games[hash] {
+		if !client.spectator {
+			names = append(names, client.playerName)
+		}
 	}
+
+	return names
 }
 
 // Just drop it if it exists, otherwise ignore
-func (handler SocketHandler) LazyRemoveClient(game *Game, con ClientConn) {
-	if clients, ok := handler[game]; ok {
+func (handler *SocketHandler) LazyRemoveClient(hash string, con ClientConn) {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+
+	if clients, ok := handler.games[hash]; ok {
 		delete(clients, con)
 	}
 }
 
-func (handler SocketHandler) NewConnection(game *Game, con ClientConn) {
+func (handler *SocketHandler) NewConnection(hash string, con ClientConn) {
 	// TODO: error reporting
-	if !gameStore.Contains(game.Hash()) {
+	if !gameStore.Contains(hash) {
 		return
 	}
 
-	if _, ok := ClientHandler[game]; !ok {
-		ClientHandler[game] = map[ClientConn]struct{}{
-			con: {},
-		}
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+
+	if _, ok := handler.games[hash]; !ok {
+		handler.games[hash] = gameClients{con: {}}
 	} else {
-		ClientHandler[game][con] = struct{}{}
+		handler.games[hash][con] = struct{}{}
+	}
+}
+
+// Whether anybody is connected to the game.
+func (handler *SocketHandler) HasClients(hash string) bool {
+	handler.lock.RLock()
+	defer handler.lock.RUnlock()
+
+	return len(handler.games[hash]) > 0
+}
+
+// Drop the game if nobody is connected to it anymore. Returns false
+// if there are still clients.
+func (handler *SocketHandler) Forget(hash string) bool {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+
+	if len(handler.games[hash]) > 0 {
+		return false
 	}
+
+	delete(handler.games, hash)
+
+	return true
+}
+
+// Send the message to the clients of all games and disconnect them
+// once they got it. Clients connecting afterwards are disconnected
+// right away.
+func (handler *SocketHandler) Close(msg GameMessage) {
+	handler.lock.RLock()
+
+	var hashes []string
+
+	for hash := range handler.games {
+		hashes = append(hashes, hash)
+	}
+
+	handler.lock.RUnlock()
+
+	for _, hash := range hashes {
+		handler.Broadcast(hash, msg)
+	}
+
+	// Clients send what they picked up before they notice.
+	close(handler.closed)
 }
 
 // WebSocket server to handle chat between clients.
@@ -73,13 +181,19 @@ func (handler SocketHandler) NewConnection(game *Game, con ClientConn) {
 // connection. As the session information is encrypted we can be sure that
 // this is a valid player.
 //
+// Connections with the spectate parameter set to a game hash are
+// spectators of that game and don't need a session.
+//
 func SockServer(ws *websocket.Conn) {
 	var game *Game
 
-	clientIP := ws.Request().RemoteAddr
-	inputChan := make(chan GameMessage)
-
 	request := ws.Request()
+
+	if gameId := request.URL.Query().Get("spectate"); len(gameId) > 0 {
+		spectatorServer(ws, gameId)
+		return
+	}
+
 	sess, err := session.GetGameSession(request)
 
 	if err != nil {
@@ -92,37 +206,97 @@ func SockServer(ws *websocket.Conn) {
 		}
 	}
 
-	sockCli := ClientConn{ws, clientIP, &inputChan, sess.PlayerName()}
-
-	// Register client connection in global ClientHandler
-	ClientHandler.NewConnection(game, sockCli)
-
-	log.Println("client connect ...", clientIP)
-
 	player, err := PlayerFromSession(sess)
 
 	if err != nil {
 		panic(err)
 	}
 
+	sockCli := newClientConn(ws, sess.PlayerName(), false)
+
+	// Register client connection in global ClientHandler
+	ClientHandler.NewConnection(game.Hash(), sockCli)
+
+	log.Println("client connect ...", sockCli.clientIP)
+
 	// Schedule sending the broadcast as the listener
 	// is the for loop below.
 	go game.Broadcast(NewJoinMessage(player))
 
+	serveClient(game, sockCli)
+}
+
+// Spectators watch the game without taking part, they don't announce
+// themselves to the players.
+func spectatorServer(ws *websocket.Conn, gameId string) {
+	if !gameStore.Contains(gameId) {
+		log.Println("spectator requested unknown game", gameId)
+		ws.Close()
+		return
+	}
+
+	game, err := gameStore.GetGameByHash(gameId)
+
+	if err != nil {
+		panic("SocketServer: game not found: " + err.Error())
+	}
+
+	credentials := JoinCredentials{Token: ws.Request().URL.Query().Get("token")}
+
+	if err := game.CanSpectate(spectatorName(ws.Request(), gameId), credentials); err != nil {
+		log.Println("spectator refused for game", gameId, err)
+		ws.Close()
+		return
+	}
+
+	sockCli := newClientConn(ws, "", true)
+
+	ClientHandler.NewConnection(game.Hash(), sockCli)
+
+	log.Println("spectator connect ...", sockCli.clientIP)
+
+	serveClient(game, sockCli)
+}
+
+// Send the messages for the client until the connection fails.
+func serveClient(game *Game, sockCli ClientConn) {
+	ws := sockCli.websocket
+
 	// cleanup on server side
 	defer func() {
-		ClientHandler.LazyRemoveClient(game, sockCli)
+		ClientHandler.LazyRemoveClient(game.Hash(), sockCli)
+		close(sockCli.done)
 
 		if err := ws.Close(); err != nil {
 			log.Println("Websocket could not be closed", err.Error())
 		}
 	}()
 
+	// Clients don't send anything, reading only fails once the client
+	// is gone.
+	gone := make(chan struct{})
+
+	go func() {
+		var ignored string
+
+		for Message.Receive(ws, &ignored) == nil {
+		}
+
+		close(gone)
+	}()
+
 	// for loop so the websocket stays open otherwise
 	// it'll close after one Receieve and Send
 	for {
 		select {
-		case msg := <-inputChan:
+		case <-gone:
+			log.Println("client disconnect ...", sockCli.clientIP)
+			return
+
+		case <-ClientHandler.closed:
+			return
+
+		case msg := <-*sockCli.inputChan:
 			res, err := json.Marshal(msg)
 
 			if err != nil {
@@ -132,9 +306,9 @@ func SockServer(ws *websocket.Conn) {
 			if err = Message.Send(ws, string(res)); err != nil {
 				// we could not send the message to a peer
 				log.Println("Could not send message to ",
-					clientIP, err.Error(), " - dropping client.")
+					sockCli.clientIP, err.Error(), " - dropping client.")
 
-				break
+				return
 			}
 		}
 	}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/githubnemo/wikirace-serv/wikis"
+	"golang.org/x/net/websocket"
+)
+
+func (handler *SocketHandler) clientCount(hash string) int {
+	handler.lock.RLock()
+	defer handler.lock.RUnlock()
+
+	return len(handler.games[hash])
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	for deadline := time.Now().Add(10 * time.Second); !condition(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s.", what)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// The session cookie of the player as the join handler sets it.
+func sessionCookie(player, hash string) (string, error) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/join", nil)
+
+	sess, err := session.GetGameSession(r)
+
+	if err != nil {
+		return "", err
+	}
+
+	sess.Init(player, hash)
+
+	if err := sess.Save(r, w); err != nil {
+		return "", err
+	}
+
+	return w.Header().Get("Set-Cookie"), nil
+}
+
+// Connect to the websocket of the server at the given http:// URL.
+func dialClient(serverURL, query, cookie string) (*websocket.Conn, error) {
+	url := "ws" + strings.TrimPrefix(serverURL, "http") + "/client" + query
+
+	config, err := websocket.NewConfig(url, serverURL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cookie) > 0 {
+		config.Header.Set("Cookie", cookie)
+	}
+
+	return websocket.DialConfig(config)
+}
+
+// Hundreds of players join, connect and race at once while spectators
+// watch. Run with -race.
+func TestConcurrentPlayersAndSockets(t *testing.T) {
+	defer func(old *GameStore) { gameStore = old }(gameStore)
+	defer func(old *GameSessionStore) { session = old }(session)
+	defer func(old *SocketHandler) { ClientHandler = old }(ClientHandler)
+
+	gameStore = NewGameStore(NewMemoryStore(), NewMemoryStore())
+	session = NewGameSessionStore()
+	ClientHandler = NewSocketHandler()
+
+	persister := gameStore.WriteBehind(time.Second)
+	go persister.Run()
+	defer persister.Stop()
+
+	game := gameStore.NewGame("host", &wikis.Wiki{})
+	game.Start = "start page"
+	game.Goal = "goal page"
+
+	if err := gameStore.PutGame(game); err != nil {
+		t.Fatal(err)
+	}
+
+	hash := game.Hash()
+
+	mux := http.NewServeMux()
+	mux.Handle("/client", websocket.Handler(SockServer))
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	const players, spectators, visits = 200, 20, 1
+
+	final := createMessage(gameend, "host", "game ended")
+
+	var received sync.WaitGroup
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var clients []*websocket.Conn
+
+	// Read messages until the final one arrives.
+	listen := func(ws *websocket.Conn) {
+		defer received.Done()
+
+		for {
+			var data string
+
+			if err := websocket.Message.Receive(ws, &data); err != nil {
+				t.Errorf("Client did not receive the final message: %s", err)
+				return
+			}
+
+			var msg struct{ GameMessage BaseGameMessage }
+
+			if err := json.Unmarshal([]byte(data), &msg); err != nil {
+				t.Error(err)
+				return
+			}
+
+			if msg.GameMessage.Type == gameend {
+				return
+			}
+		}
+	}
+
+	connect := func(query, cookie string) {
+		ws, err := dialClient(server.URL, query, cookie)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		lock.Lock()
+		clients = append(clients, ws)
+		lock.Unlock()
+
+		received.Add(1)
+		go listen(ws)
+	}
+
+	for i := 0; i < spectators; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			connect("?spectate="+hash, "")
+		}()
+	}
+
+	for i := 0; i < players; i++ {
+		wg.Add(1)
+
+		go func(name string) {
+			defer wg.Done()
+
+			// Every player joins the same way, reloading the game as
+			// the handlers do.
+			game, err := gameStore.GetGameByHash(hash)
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if err := game.Join(name, "", JoinCredentials{}); err != nil {
+				t.Error(err)
+				return
+			}
+
+			cookie, err := sessionCookie(name, hash)
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			connect("", cookie)
+
+			r := httptest.NewRequest("GET", "/visit", nil)
+			r.Header.Set("Cookie", cookie)
+
+			sess, err := session.GetGameSession(r)
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			for j := 0; j < visits; j++ {
+				player, err := PlayerFromSession(sess)
+
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				page := fmt.Sprintf("page %d", j)
+
+				game.Visit(player, page)
+				game.Broadcast(NewVisitMessage(sess, page, player))
+			}
+		}(fmt.Sprintf("player %d", i))
+	}
+
+	wg.Wait()
+
+	waitFor(t, "all clients to connect", func() bool {
+		return ClientHandler.clientCount(hash) == players+spectators
+	})
+
+	if connected := ClientHandler.ConnectedPlayers(hash); len(connected) != players {
+		t.Errorf("Expected %d connected players, got %d.", players, len(connected))
+	}
+
+	game.Broadcast(final)
+
+	received.Wait()
+
+	for i := 0; i < players; i++ {
+		name := fmt.Sprintf("player %d", i)
+
+		if p := game.PlayerCopy(name); p == nil || len(p.Path) != visits {
+			t.Errorf("Player %s is missing visits: %#v", name, p)
+		}
+	}
+
+	for _, ws := range clients {
+		ws.Close()
+	}
+
+	// Leaving clients are noticed and dropped, broadcasts don't wait for
+	// them.
+	waitFor(t, "all clients to leave", func() bool {
+		game.Broadcast(final)
+		return !ClientHandler.HasClients(hash)
+	})
+
+	if !ClientHandler.Forget(hash) {
+		t.Error("Game without clients was not forgotten.")
+	}
+}
+
+func TestPrivateGameSpectatorSocket(t *testing.T) {
+	defer func(old *GameStore) { gameStore = old }(gameStore)
+	defer func(old *GameSessionStore) { session = old }(session)
+	defer func(old *SocketHandler) { ClientHandler = old }(ClientHandler)
+
+	gameStore = NewGameStore(NewMemoryStore(), NewMemoryStore())
+	session = NewGameSessionStore()
+	ClientHandler = NewSocketHandler()
+	inviteKey = []byte("test key")
+
+	game := gameStore.NewGame("host", &wikis.Wiki{})
+	game.MakePrivate("secret")
+
+	if err := gameStore.PutGame(game); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/client", websocket.Handler(SockServer))
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// Turned away: the connection is closed without any message.
+	ws, err := dialClient(server.URL, "?spectate="+game.Hash(), "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var data string
+
+	if err := websocket.Message.Receive(ws, &data); err == nil {
+		t.Errorf("Spectator without token received %s.", data)
+	}
+
+	ws.Close()
+
+	ws, err = dialClient(server.URL, "?spectate="+game.Hash()+"&token="+game.InviteToken(), "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the spectator with token to connect", func() bool {
+		return ClientHandler.clientCount(game.Hash()) == 1
+	})
+
+	ws.Close()
+
+	waitFor(t, "the spectator to leave", func() bool {
+		return ClientHandler.clientCount(game.Hash()) == 0
+	})
+}
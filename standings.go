@@ -0,0 +1,279 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// The state a player is in from the perspective of the race.
+type PlayerStatus int
+
+const (
+	// Still on the way to the goal.
+	StatusRacing PlayerStatus = iota
+
+	// Reached the goal.
+	StatusFinished
+
+	// Left the game without reaching the goal.
+	StatusGaveUp
+
+	// Did not reach the goal within the time limit of the game or
+	// before the host ended the game.
+	StatusTimedOut
+
+	// Was removed from the game by the host.
+	StatusKicked
+)
+
+func (s PlayerStatus) String() string {
+	switch s {
+	case StatusRacing:
+		return "racing"
+	case StatusFinished:
+		return "finished"
+	case StatusGaveUp:
+		return "gave up"
+	case StatusTimedOut:
+		return "timed out"
+	case StatusKicked:
+		return "kicked"
+	}
+	return "unknown"
+}
+
+// Only racing players can still change the outcome of the game.
+func (s PlayerStatus) IsActive() bool {
+	return s == StatusRacing
+}
+
+func (s PlayerStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *PlayerStatus) UnmarshalText(text []byte) error {
+	for _, e := range []PlayerStatus{StatusRacing, StatusFinished, StatusGaveUp, StatusTimedOut, StatusKicked} {
+		if e.String() == string(text) {
+			*s = e
+			return nil
+		}
+	}
+	*s = StatusRacing
+	return nil
+}
+
+// The rules of a race that decide whether a player is done.
+type RaceRules struct {
+	Goal string
+
+	// Checkpoints a player has to pass before the goal counts.
+	Checkpoints []string
+
+	// Zero if there is no time limit.
+	TimeLimit time.Duration
+
+	// Clicks added to the score for every hint used.
+	HintPenalty int
+
+	// The host ended the game, nobody is racing anymore.
+	Ended bool
+}
+
+// Placement of a single player in a game.
+type Standing struct {
+	// Placement of the player, starting at 1. Players that are tied
+	// share the same rank and the following rank is skipped (1, 1, 3).
+	Rank int
+
+	Name   string
+	Team   string
+	Status PlayerStatus
+
+	// Number of pages visited, including the start page.
+	Clicks int
+
+	// Clicks added for used hints and the resulting score which is
+	// the sum of both. Players are ranked by score.
+	Penalty int
+	Score   int
+
+	// Number of checkpoints the player passed.
+	Checkpoints int
+
+	// Time the player took to finish or, if the player is not finished,
+	// the time spent in the game so far. Truncated to seconds so that
+	// ties are possible.
+	Time time.Duration
+}
+
+// Standings of all players in a game, ordered by rank.
+type Standings []Standing
+
+// The best finished player or nil if nobody reached the goal yet.
+func (s Standings) Leader() *Standing {
+	if len(s) == 0 || s[0].Status != StatusFinished {
+		return nil
+	}
+	return &s[0]
+}
+
+// The game is over when somebody finished and no player that is still
+// racing has a lower score than the leader, i.e. nobody can win anymore.
+// Without a leader it is over once nobody is racing anymore, e.g. when
+// everybody gave up.
+func (s Standings) IsOver() bool {
+	leader := s.Leader()
+
+	if leader == nil {
+		return len(s) > 0 && !s.hasActive()
+	}
+
+	for _, e := range s {
+		if e.Status.IsActive() && e.Score < leader.Score {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s Standings) hasActive() bool {
+	for _, e := range s {
+		if e.Status.IsActive() {
+			return true
+		}
+	}
+	return false
+}
+
+// Standing of the player with the given name, nil if there is none.
+func (s Standings) Get(name string) *Standing {
+	for i := range s {
+		if s[i].Name == name {
+			return &s[i]
+		}
+	}
+	return nil
+}
+
+// The player with the given name is the leader of the standings.
+// Players that are tied with the leader are leaders as well.
+func (s Standings) IsLeader(name string) bool {
+	p := s.Get(name)
+	return p != nil && p.Status == StatusFinished && p.Rank == 1
+}
+
+// The player is the leader and the game is over.
+func (s Standings) IsWinner(name string) bool {
+	return s.IsOver() && s.IsLeader(name)
+}
+
+// Order of the statuses in the standings. Finished players come first,
+// players that are still able to finish before those who are not.
+var statusOrder = map[PlayerStatus]int{
+	StatusFinished: 0,
+	StatusRacing:   1,
+	StatusTimedOut: 2,
+	StatusGaveUp:   3,
+	StatusKicked:   4,
+}
+
+type sortableStandings Standings
+
+func (s sortableStandings) Len() int      { return len(s) }
+func (s sortableStandings) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s sortableStandings) Less(i, j int) bool {
+	if statusOrder[s[i].Status] != statusOrder[s[j].Status] {
+		return statusOrder[s[i].Status] < statusOrder[s[j].Status]
+	}
+	if s[i].Score != s[j].Score {
+		return s[i].Score < s[j].Score
+	}
+	if s[i].Status == StatusFinished && s[i].Time != s[j].Time {
+		return s[i].Time < s[j].Time
+	}
+	return s[i].Name < s[j].Name
+}
+
+// Two standings share a rank when they have the same status and score.
+// Finished players additionally need to have the same time.
+func (s sortableStandings) tied(i, j int) bool {
+	a, b := s[i], s[j]
+
+	if a.Status != b.Status || a.Score != b.Score {
+		return false
+	}
+
+	return a.Status != StatusFinished || a.Time == b.Time
+}
+
+// Status of the player at the given time.
+func playerStatus(p *Player, rules RaceRules, now time.Time) PlayerStatus {
+	switch {
+	case p.Kicked:
+		return StatusKicked
+	case p.HasFinished(rules):
+		return StatusFinished
+	case p.LeftGame:
+		return StatusGaveUp
+	case rules.Ended:
+		return StatusTimedOut
+	case rules.TimeLimit > 0 && !p.JoinedAt.IsZero() && now.Sub(p.JoinedAt) > rules.TimeLimit:
+		return StatusTimedOut
+	}
+	return StatusRacing
+}
+
+// Time the player has spent in the race. Finished players are measured
+// up to the visit of the goal page, all others up to now.
+func playerTime(p *Player, status PlayerStatus, now time.Time) time.Duration {
+	if p.JoinedAt.IsZero() {
+		return 0
+	}
+
+	end := now
+
+	if status != StatusRacing && !p.LastVisitAt.IsZero() {
+		end = p.LastVisitAt
+	}
+
+	if end.Before(p.JoinedAt) {
+		return 0
+	}
+
+	return end.Sub(p.JoinedAt) / time.Second * time.Second
+}
+
+// Compute the standings of the given players without modifying them.
+func ComputeStandings(players []Player, rules RaceRules, now time.Time) Standings {
+	standings := make(Standings, len(players))
+
+	for i := range players {
+		p := &players[i]
+		status := playerStatus(p, rules, now)
+		penalty := len(p.Hints) * rules.HintPenalty
+
+		standings[i] = Standing{
+			Name:        p.Name,
+			Team:        p.Team,
+			Status:      status,
+			Clicks:      len(p.Path),
+			Penalty:     penalty,
+			Score:       len(p.Path) + penalty,
+			Checkpoints: len(p.Checkpoints),
+			Time:        playerTime(p, status, now),
+		}
+	}
+
+	sort.Sort(sortableStandings(standings))
+
+	for i := range standings {
+		if i > 0 && sortableStandings(standings).tied(i-1, i) {
+			standings[i].Rank = standings[i-1].Rank
+		} else {
+			standings[i].Rank = i + 1
+		}
+	}
+
+	return standings
+}
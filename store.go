@@ -2,41 +2,305 @@ package main
 
 import (
 	"encoding/json"
-	"github.com/peterbourgon/diskv"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 )
 
+// Storage of raw values by key. Implementations are safe for concurrent
+// access.
+type Backend interface {
+	Read(key string) ([]byte, error)
+	Write(key string, value []byte) error
+	Erase(key string) error
+	Has(key string) bool
+
+	// Keys starting with the prefix, all keys if the prefix is empty.
+	Keys(prefix string) ([]string, error)
+
+	Close() error
+}
+
 // Persistent storage with marhsalling.
 //
 // All crucial actions on this store (Write, Erase, ...) are locked
 // and safe for concurrent access.
 type Store struct {
-	*diskv.Diskv
+	Backend
+
+	// Held for a key while its versioned value is compared and written.
+	versionLocks keyLocks
+
+	// Stored versions by key, remembered from the last versioned write
+	// so that the stored value doesn't have to be read again.
+	versions map[string]int
+
+	// Lock for versions
+	versionsLock sync.Mutex
+}
+
+// Mutexes by key, created on demand and dropped when nobody holds or
+// waits for them. The zero value is ready to use.
+type keyLocks struct {
+	locks map[string]*keyLock
+
+	// Lock for locks
+	lock sync.Mutex
+}
+
+type keyLock struct {
+	sync.Mutex
+
+	// Goroutines holding or waiting for the lock
+	users int
+}
+
+func (k *keyLocks) Lock(key string) {
+	k.lock.Lock()
+
+	if k.locks == nil {
+		k.locks = make(map[string]*keyLock)
+	}
+
+	l, ok := k.locks[key]
+
+	if !ok {
+		l = &keyLock{}
+		k.locks[key] = l
+	}
+
+	l.users++
+
+	k.lock.Unlock()
+
+	l.Lock()
+}
+
+func (k *keyLocks) Unlock(key string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	l := k.locks[key]
+	l.Unlock()
+
+	if l.users--; l.users == 0 {
+		delete(k.locks, key)
+	}
+}
+
+// Values with a version counter. Versioned values are only written if
+// their version is the version that is stored, see PutMarshal.
+type Versioned interface {
+	version() *int
 }
 
+// Returned when a versioned value is written that is older than the
+// stored one.
+type VersionConflictError struct {
+	Key      string
+	Version  int
+	Expected int
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("Version %d of %s is outdated, the stored version is %d.", e.Version, e.Key, e.Expected)
+}
+
+// Store backed by one JSON file per key in the given directory.
 func NewStore(dir string) *Store {
-	s := diskv.New(diskv.Options{
-		BasePath: dir,
-	})
+	return &Store{Backend: newDiskvBackend(dir, false)}
+}
+
+// Like NewStore but the stored values are compressed with gzip. Meant
+// for data that is rarely read, like archived games.
+func NewCompressedStore(dir string) *Store {
+	return &Store{Backend: newDiskvBackend(dir, true)}
+}
+
+// Store that only lives in memory. Meant for tests.
+func NewMemoryStore() *Store {
+	return &Store{Backend: newMemoryBackend()}
+}
+
+// Store backed by a single file embedded key/value database.
+func NewBoltStore(path string) (*Store, error) {
+	backend, err := newBoltBackend(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Store{Backend: backend}, nil
+}
 
-	return &Store{s}
+// Open the store described by spec, which is the kind of store and its
+// location separated by a colon: "diskv:./games", "bolt:./games.db" or
+// just "memory".
+func OpenStore(spec string) (*Store, error) {
+	kind, location := splitStoreSpec(spec)
+
+	switch kind {
+	case "diskv":
+		return NewStore(location), nil
+	case "bolt":
+		return NewBoltStore(location)
+	case "memory":
+		return NewMemoryStore(), nil
+	}
+
+	return nil, fmt.Errorf("Unknown store %q, use diskv:<dir>, bolt:<file> or memory.", spec)
+}
+
+func splitStoreSpec(spec string) (kind, location string) {
+	if i := strings.Index(spec, ":"); i >= 0 {
+		return spec[:i], spec[i+1:]
+	}
+
+	return spec, ""
 }
 
+// Returned while another process, like the running server, uses the
+// store, see LockStore.
+var errStoreInUse = errors.New("The store is in use by another process, e.g. the server.")
+
+// Claim the store described by the spec, see OpenStore, for this process
+// until it exits or unlock is called. Directory stores are locked with
+// the file <dir>.lock next to them, bolt files are locked when they are
+// opened and memory stores are never shared.
+func LockStore(spec string) (unlock func(), err error) {
+	kind, location := splitStoreSpec(spec)
+
+	if kind != "diskv" {
+		return func() {}, nil
+	}
+
+	file, err := os.OpenFile(filepath.Clean(location)+".lock", os.O_CREATE|os.O_RDWR, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The lock is released when the file is closed, also if the process
+	// dies.
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+
+		if err == syscall.EWOULDBLOCK {
+			return nil, errStoreInUse
+		}
+
+		return nil, err
+	}
+
+	return func() { file.Close() }, nil
+}
+
+// Write the value as JSON. Versioned values are compared to the stored
+// version first: if they differ a *VersionConflictError is returned,
+// otherwise the version is incremented and the value written.
 func (g *Store) PutMarshal(hash string, v interface{}) error {
-	bytes, err := json.MarshalIndent(v, "", "  ")
+	if versioned, ok := v.(Versioned); ok {
+		return g.putVersioned(hash, versioned)
+	}
+
+	return g.putMarshal(hash, v)
+}
+
+func (g *Store) putVersioned(hash string, v Versioned) error {
+	g.versionLocks.Lock(hash)
+	defer g.versionLocks.Unlock(hash)
+
+	stored, err := g.storedVersion(hash)
 
 	if err != nil {
 		return err
 	}
 
-	// XXX: circumvent a bug in diskv when the new content has fewer bytes
-	// than the new
-	g.Diskv.Erase(hash)
+	version := v.version()
+
+	if *version != stored {
+		return &VersionConflictError{hash, *version, stored}
+	}
+
+	*version++
+
+	if err := g.putMarshal(hash, v); err != nil {
+		*version--
+		return err
+	}
+
+	g.versionsLock.Lock()
+	g.versions[hash] = *version
+	g.versionsLock.Unlock()
 
-	return g.Diskv.Write(hash, bytes)
+	return nil
+}
+
+// Version of the stored value. Only read from the backend if the value
+// was not written through this store yet.
+func (g *Store) storedVersion(hash string) (int, error) {
+	g.versionsLock.Lock()
+
+	if g.versions == nil {
+		g.versions = make(map[string]int)
+	}
+
+	version, ok := g.versions[hash]
+
+	g.versionsLock.Unlock()
+
+	if ok || !g.Has(hash) {
+		return version, nil
+	}
+
+	var stored struct{ Version int }
+
+	if err := g.GetMarshal(hash, &stored); err != nil {
+		return 0, err
+	}
+
+	return stored.Version, nil
+}
+
+// The stored version is read again on the next versioned write.
+func (g *Store) forgetVersion(hash string) {
+	g.versionLocks.Lock(hash)
+	defer g.versionLocks.Unlock(hash)
+
+	g.versionsLock.Lock()
+	delete(g.versions, hash)
+	g.versionsLock.Unlock()
+}
+
+// Write the raw value, bypassing the version check.
+func (g *Store) Write(hash string, value []byte) error {
+	defer g.forgetVersion(hash)
+
+	return g.Backend.Write(hash, value)
+}
+
+func (g *Store) Erase(hash string) error {
+	defer g.forgetVersion(hash)
+
+	return g.Backend.Erase(hash)
+}
+
+func (g *Store) putMarshal(hash string, v interface{}) error {
+	bytes, err := json.MarshalIndent(v, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return g.Backend.Write(hash, bytes)
 }
 
 func (g *Store) GetMarshal(hash string, v interface{}) error {
-	bytes, err := g.Diskv.Read(hash)
+	bytes, err := g.Read(hash)
 
 	if err != nil {
 		return err
@@ -46,10 +310,29 @@ func (g *Store) GetMarshal(hash string, v interface{}) error {
 }
 
 func (g *Store) Contains(hash string) bool {
-	for key := range g.Keys(nil) {
-		if key == hash {
-			return true
+	return g.Has(hash)
+}
+
+// Copy every value of the store to the other store. Returns the number
+// of copied values.
+func (g *Store) CopyTo(other *Store) (int, error) {
+	keys, err := g.Keys("")
+
+	if err != nil {
+		return 0, err
+	}
+
+	for i, key := range keys {
+		value, err := g.Read(key)
+
+		if err != nil {
+			return i, err
+		}
+
+		if err := other.Write(key, value); err != nil {
+			return i, err
 		}
 	}
-	return false
+
+	return len(keys), nil
 }
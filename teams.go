@@ -0,0 +1,229 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// How the result of a team is computed from the results of its members.
+type TeamScoring string
+
+const (
+	// The result of the best member is the result of the team.
+	ScoreBestMember TeamScoring = "best"
+
+	// The average result of all members that reached the goal is the
+	// result of the team. The result is final once no member is racing.
+	ScoreAverage TeamScoring = "average"
+)
+
+func ParseTeamScoring(s string) TeamScoring {
+	if TeamScoring(s) == ScoreAverage {
+		return ScoreAverage
+	}
+	return ScoreBestMember
+}
+
+// Placement of a team in a game.
+type TeamStanding struct {
+	// Placement of the team, starting at 1. Tied teams share a rank.
+	Rank int
+
+	Team string
+
+	// Names of the members of the team
+	Members []string
+
+	// StatusFinished when the result of the team is final,
+	// StatusRacing if members are still racing and the other
+	// statuses when no member can reach the goal anymore.
+	Status PlayerStatus
+
+	// Score (clicks including penalties) and time of the team according
+	// to the scoring. Only meaningful if at least one member finished.
+	Score float64
+	Time  time.Duration
+
+	// The best score the team can still achieve, assuming that racing
+	// members are about to reach the goal.
+	potential float64
+}
+
+// Standings of all teams in a game, ordered by rank.
+type TeamStandings []TeamStanding
+
+func (s TeamStandings) Leader() *TeamStanding {
+	if len(s) == 0 || s[0].Status != StatusFinished {
+		return nil
+	}
+	return &s[0]
+}
+
+func (s TeamStandings) Get(team string) *TeamStanding {
+	for i := range s {
+		if s[i].Team == team {
+			return &s[i]
+		}
+	}
+	return nil
+}
+
+// The game is over when a team has a final result and no other team can
+// beat that result with the players it still has racing. Without a
+// leader it is over once no team is racing anymore.
+func (s TeamStandings) IsOver() bool {
+	leader := s.Leader()
+
+	if leader == nil {
+		for _, e := range s {
+			if e.Status == StatusRacing {
+				return false
+			}
+		}
+		return len(s) > 0
+	}
+
+	for _, e := range s {
+		if e.Team != leader.Team && e.potential < leader.Score {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s TeamStandings) IsLeader(team string) bool {
+	t := s.Get(team)
+	return t != nil && t.Status == StatusFinished && t.Rank == 1
+}
+
+func (s TeamStandings) IsWinner(team string) bool {
+	return s.IsOver() && s.IsLeader(team)
+}
+
+type sortableTeamStandings TeamStandings
+
+func (s sortableTeamStandings) Len() int      { return len(s) }
+func (s sortableTeamStandings) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s sortableTeamStandings) Less(i, j int) bool {
+	if statusOrder[s[i].Status] != statusOrder[s[j].Status] {
+		return statusOrder[s[i].Status] < statusOrder[s[j].Status]
+	}
+	if s[i].Score != s[j].Score {
+		return s[i].Score < s[j].Score
+	}
+	if s[i].Time != s[j].Time {
+		return s[i].Time < s[j].Time
+	}
+	return s[i].Team < s[j].Team
+}
+
+func (s sortableTeamStandings) tied(i, j int) bool {
+	return s[i].Status == s[j].Status && s[i].Score == s[j].Score && s[i].Time == s[j].Time
+}
+
+// Compute the result of a single team from the standings of its members.
+func teamStanding(team string, members Standings, scoring TeamScoring) TeamStanding {
+	t := TeamStanding{Team: team, Status: StatusGaveUp}
+
+	var finished, racing int
+	var sumScore int
+	var sumTime time.Duration
+
+	bestScore, bestTime := -1, time.Duration(0)
+
+	for _, m := range members {
+		t.Members = append(t.Members, m.Name)
+
+		switch m.Status {
+		case StatusFinished:
+			finished++
+			sumScore += m.Score
+			sumTime += m.Time
+
+			if bestScore < 0 || m.Score < bestScore || (m.Score == bestScore && m.Time < bestTime) {
+				bestScore, bestTime = m.Score, m.Time
+			}
+		case StatusRacing:
+			racing++
+		case StatusTimedOut:
+			t.Status = StatusTimedOut
+		}
+	}
+
+	switch scoring {
+	case ScoreAverage:
+		if finished > 0 {
+			t.Score = float64(sumScore) / float64(finished)
+			t.Time = sumTime / time.Duration(finished)
+		}
+
+		// Racing members may still change the average.
+		switch {
+		case racing > 0:
+			t.Status = StatusRacing
+		case finished > 0:
+			t.Status = StatusFinished
+		}
+	default:
+		if finished > 0 {
+			t.Score = float64(bestScore)
+			t.Time = bestTime
+		}
+
+		// Racing members can only improve the result of the team.
+		switch {
+		case finished > 0:
+			t.Status = StatusFinished
+		case racing > 0:
+			t.Status = StatusRacing
+		}
+	}
+
+	// Racing members can pull the result down to their current score
+	// at best. Teams without anybody able to finish can't beat anyone.
+	t.potential = math.Inf(1)
+
+	if finished > 0 {
+		t.potential = t.Score
+	}
+
+	for _, m := range members {
+		if m.Status == StatusRacing && float64(m.Score) < t.potential {
+			t.potential = float64(m.Score)
+		}
+	}
+
+	return t
+}
+
+// Compute the team standings from the standings of the players.
+// Players without a team are ignored.
+func ComputeTeamStandings(standings Standings, teams []string, scoring TeamScoring) TeamStandings {
+	result := make(TeamStandings, len(teams))
+
+	for i, team := range teams {
+		var members Standings
+
+		for _, s := range standings {
+			if s.Team == team {
+				members = append(members, s)
+			}
+		}
+
+		result[i] = teamStanding(team, members, scoring)
+	}
+
+	sort.Sort(sortableTeamStandings(result))
+
+	for i := range result {
+		if i > 0 && sortableTeamStandings(result).tied(i-1, i) {
+			result[i].Rank = result[i-1].Rank
+		} else {
+			result[i].Rank = i + 1
+		}
+	}
+
+	return result
+}
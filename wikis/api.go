@@ -0,0 +1,398 @@
+package wikis
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Path of the MediaWiki API relative to the wiki URL if the wiki
+// configuration does not specify one.
+const DefaultAPIPath = "/w/api.php"
+
+// Returned when the host chose the same page as start and goal.
+var ErrSameStartAndGoal = errors.New("Start and goal are the same page.")
+
+// Returned when a page requested by title does not exist in the wiki.
+type NoSuchPageError struct {
+	Title string
+}
+
+func (e *NoSuchPageError) Error() string {
+	return fmt.Sprintf("There is no page with the title %q.", e.Title)
+}
+
+// Page titles in links use underscores where the displayed title
+// uses spaces. Normalize both to the displayed form.
+func NormalizeTitle(title string) string {
+	return strings.TrimSpace(strings.Replace(title, "_", " ", -1))
+}
+
+// Whether both titles reference the same page.
+func SamePage(a, b string) bool {
+	return NormalizeTitle(a) == NormalizeTitle(b)
+}
+
+func (wiki *Wiki) apiURL(params url.Values) string {
+	path := wiki.APIPath
+
+	if len(path) == 0 {
+		path = DefaultAPIPath
+	}
+
+	params.Set("format", "json")
+
+	return wiki.URL + path + "?" + params.Encode()
+}
+
+// Query the MediaWiki API with the given parameters and decode the
+// JSON response into v.
+func (wiki *Wiki) apiGet(params url.Values, v interface{}) error {
+	resp, err := http.Get(wiki.apiURL(params))
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Wiki API returned status %s.", resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Find titles of articles starting with the given prefix using the
+// opensearch API of the wiki. Used for autocompletion.
+func (wiki *Wiki) Search(prefix string, limit int) ([]string, error) {
+	params := url.Values{}
+	params.Set("action", "opensearch")
+	params.Set("search", prefix)
+	params.Set("namespace", "0")
+	params.Set("limit", fmt.Sprint(limit))
+
+	// The response is [query, [titles...], [descriptions...], [urls...]]
+	var result []json.RawMessage
+
+	if err := wiki.apiGet(params, &result); err != nil {
+		return nil, err
+	}
+
+	if len(result) < 2 {
+		return nil, fmt.Errorf("Unexpected opensearch response.")
+	}
+
+	var titles []string
+
+	if err := json.Unmarshal(result[1], &titles); err != nil {
+		return nil, err
+	}
+
+	return titles, nil
+}
+
+// Resolve the canonical title of the page with the given title.
+// Redirects are followed so that "CPU" resolves to "Central processing
+// unit". Returns a *NoSuchPageError if the page does not exist.
+func (wiki *Wiki) ResolveTitle(title string) (string, error) {
+	params := url.Values{}
+	params.Set("action", "query")
+	params.Set("titles", NormalizeTitle(title))
+	params.Set("redirects", "")
+
+	var result struct {
+		Query struct {
+			Pages map[string]struct {
+				Title   string
+				Missing interface{} `json:"missing"`
+				Invalid interface{} `json:"invalid"`
+			}
+		}
+	}
+
+	if err := wiki.apiGet(params, &result); err != nil {
+		return "", err
+	}
+
+	for _, page := range result.Query.Pages {
+		if page.Missing != nil || page.Invalid != nil || len(page.Title) == 0 {
+			return "", &NoSuchPageError{title}
+		}
+
+		return page.Title, nil
+	}
+
+	return "", &NoSuchPageError{title}
+}
+
+// Title of a random article of the wiki.
+func (wiki *Wiki) RandomTitle() (string, error) {
+	return wiki.PageTitle(wiki.PageLink(wiki.RandomPage))
+}
+
+// Start and goal chosen by the seed. The same seed gives the same pages
+// as long as the wiki does not change, on every server. Used for races
+// that everybody plays, like the daily race.
+func (wiki *Wiki) SeededStartAndGoal(seed int64) (string, string, error) {
+	r := rand.New(rand.NewSource(seed))
+
+	start, err := wiki.titleFrom(seededTitlePrefix(r))
+
+	if err != nil {
+		return "", "", err
+	}
+
+	for i := 0; i < 10; i++ {
+		goal, err := wiki.titleFrom(seededTitlePrefix(r))
+
+		if err != nil {
+			return "", "", err
+		}
+
+		if !SamePage(start, goal) {
+			return start, goal, nil
+		}
+	}
+
+	return "", "", ErrSameStartAndGoal
+}
+
+// A title prefix like "Kaw" to pick an article with, see titleFrom.
+func seededTitlePrefix(r *rand.Rand) string {
+	const upper, lower = "ABCDEFGHIJKLMNOPQRSTUVWXYZ", "abcdefghijklmnopqrstuvwxyz"
+
+	return string([]byte{upper[r.Intn(len(upper))], lower[r.Intn(len(lower))], lower[r.Intn(len(lower))]})
+}
+
+// Title of the first article, by alphabet, starting at from. Wraps
+// around to the first article of the wiki.
+func (wiki *Wiki) titleFrom(from string) (string, error) {
+	params := url.Values{}
+	params.Set("action", "query")
+	params.Set("list", "allpages")
+	params.Set("apnamespace", "0")
+	params.Set("apfilterredir", "nonredirects")
+	params.Set("aplimit", "1")
+	params.Set("apfrom", from)
+
+	var result struct {
+		Query struct {
+			AllPages []struct {
+				Title string
+			}
+		}
+	}
+
+	if err := wiki.apiGet(params, &result); err != nil {
+		return "", err
+	}
+
+	if len(result.Query.AllPages) > 0 {
+		return result.Query.AllPages[0].Title, nil
+	}
+
+	if len(from) > 0 {
+		return wiki.titleFrom("")
+	}
+
+	return "", fmt.Errorf("The wiki has no articles.")
+}
+
+// Determine start and goal of a game from the titles chosen by the host.
+// Chosen titles are resolved to their canonical titles, empty titles are
+// replaced by random articles.
+func (wiki *Wiki) ChooseStartAndGoal(start, goal string) (string, string, error) {
+	start, goal = strings.TrimSpace(start), strings.TrimSpace(goal)
+
+	if len(start) == 0 && len(goal) == 0 {
+		return wiki.DetermineStartAndGoal()
+	}
+
+	resolve := func(title string) (string, error) {
+		if len(title) == 0 {
+			return wiki.RandomTitle()
+		}
+		return wiki.ResolveTitle(title)
+	}
+
+	start, err := resolve(start)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	goal, err = resolve(goal)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	if SamePage(start, goal) {
+		return "", "", ErrSameStartAndGoal
+	}
+
+	return start, goal, nil
+}
+
+// Maximum number of titles per API query.
+const maxTitlesPerQuery = 50
+
+// Categories of the pages with the given titles, without the namespace
+// prefix ("Category:"). Redirects are followed, the result is keyed by
+// the titles as given. Hidden maintenance categories are included.
+// Without hidden they are left out.
+func (wiki *Wiki) PageCategories(titles []string, hidden bool) (map[string][]string, error) {
+	categories := make(map[string][]string)
+
+	for len(titles) > 0 {
+		n := len(titles)
+
+		if n > maxTitlesPerQuery {
+			n = maxTitlesPerQuery
+		}
+
+		if err := wiki.pageCategories(titles[:n], hidden, categories); err != nil {
+			return nil, err
+		}
+
+		titles = titles[n:]
+	}
+
+	return categories, nil
+}
+
+func (wiki *Wiki) pageCategories(titles []string, hidden bool, categories map[string][]string) error {
+	normalized := make([]string, len(titles))
+
+	for i, title := range titles {
+		normalized[i] = NormalizeTitle(title)
+	}
+
+	params := url.Values{}
+	params.Set("action", "query")
+	params.Set("prop", "categories")
+	params.Set("cllimit", "max")
+	params.Set("redirects", "")
+
+	if !hidden {
+		params.Set("clshow", "!hidden")
+	}
+
+	params.Set("titles", strings.Join(normalized, "|"))
+
+	type mapping struct{ From, To string }
+
+	var result struct {
+		Query struct {
+			Normalized []mapping
+			Redirects  []mapping
+			Pages      map[string]struct {
+				Title      string
+				Categories []struct{ Title string }
+			}
+		}
+	}
+
+	if err := wiki.apiGet(params, &result); err != nil {
+		return err
+	}
+
+	byTitle := make(map[string][]string)
+
+	for _, page := range result.Query.Pages {
+		for _, c := range page.Categories {
+			name := c.Title
+
+			if i := strings.Index(name, ":"); i >= 0 {
+				name = name[i+1:]
+			}
+
+			byTitle[page.Title] = append(byTitle[page.Title], name)
+		}
+	}
+
+	resolve := func(title string, mappings []mapping) string {
+		for _, m := range mappings {
+			if m.From == title {
+				return m.To
+			}
+		}
+		return title
+	}
+
+	for i, title := range titles {
+		target := resolve(resolve(normalized[i], result.Query.Normalized), result.Query.Redirects)
+		categories[title] = byTitle[target]
+	}
+
+	return nil
+}
+
+// Titles of the articles linked on the page with the given title.
+// Only the first batch of links returned by the API is considered,
+// which is enough for all but the longest pages.
+func (wiki *Wiki) PageLinks(title string) ([]string, error) {
+	params := url.Values{}
+	params.Set("action", "query")
+	params.Set("prop", "links")
+	params.Set("plnamespace", "0")
+	params.Set("pllimit", "max")
+	params.Set("redirects", "")
+	params.Set("titles", NormalizeTitle(title))
+
+	var result struct {
+		Query struct {
+			Pages map[string]struct {
+				Links []struct{ Title string }
+			}
+		}
+	}
+
+	if err := wiki.apiGet(params, &result); err != nil {
+		return nil, err
+	}
+
+	var links []string
+
+	for _, page := range result.Query.Pages {
+		for _, l := range page.Links {
+			links = append(links, l.Title)
+		}
+	}
+
+	return links, nil
+}
+
+// Titles of the articles linking to the page with the given title.
+// Like PageLinks only the first batch is considered.
+func (wiki *Wiki) Backlinks(title string) ([]string, error) {
+	params := url.Values{}
+	params.Set("action", "query")
+	params.Set("list", "backlinks")
+	params.Set("blnamespace", "0")
+	params.Set("bllimit", "max")
+	params.Set("bltitle", NormalizeTitle(title))
+
+	var result struct {
+		Query struct {
+			Backlinks []struct{ Title string }
+		}
+	}
+
+	if err := wiki.apiGet(params, &result); err != nil {
+		return nil, err
+	}
+
+	var links []string
+
+	for _, l := range result.Query.Backlinks {
+		links = append(links, l.Title)
+	}
+
+	return links, nil
+}
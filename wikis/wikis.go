@@ -10,6 +10,7 @@ import (
 	"html/template"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 )
@@ -63,6 +64,9 @@ type Wiki struct {
 
 	// The CSS selector that points to the content of the wiki page.
 	BodySelector string
+
+	// Path to the MediaWiki API relative to URL, DefaultAPIPath if empty.
+	APIPath string
 }
 
 // Generate a full HTTP link to the given page on this wiki.
@@ -71,6 +75,12 @@ func (wiki *Wiki) PageLink(page string) string {
 }
 
 func (wiki *Wiki) ServeWikiPage(page string, w http.ResponseWriter) {
+	wiki.ServeFilteredWikiPage(page, w, nil)
+}
+
+// Like ServeWikiPage but links to pages rejected by the filter are
+// disabled. A nil filter accepts all pages.
+func (wiki *Wiki) ServeFilteredWikiPage(page string, w http.ResponseWriter, filter LinkFilter) {
 	doc, err := goquery.NewDocument(wiki.PageLink(page))
 	addCSSOverride(doc)
 
@@ -81,7 +91,7 @@ func (wiki *Wiki) ServeWikiPage(page string, w http.ResponseWriter) {
 	// Links are not clickable as they don't link to a page.
 	wiki.removeLinksFromImages(doc)
 
-	content, err := wiki.rewriteWikiURLs(doc)
+	content, err := wiki.rewriteWikiURLs(doc, filter)
 
 	if err != nil {
 		panic(err)
@@ -220,7 +230,50 @@ func addCSSOverride(doc *goquery.Document) {
 // that is used to identify the page.
 type TranslatorFunc func(page string) string
 
-func (wiki *Wiki) rewriteWikiURLs(doc *goquery.Document) (string, error) {
+// A link filter receives the titles of all pages linked on a wiki page
+// and returns those of them that may not be visited.
+type LinkFilter func(wiki *Wiki, pages []string) (map[string]bool, error)
+
+// Collect the titles of all supported links in the content of the page.
+func (wiki *Wiki) linkedPages(doc *goquery.Document) []string {
+	var pages []string
+
+	seen := make(map[string]bool)
+
+	collector := func(i int, e *goquery.Selection) {
+		link, ok := e.Attr("href")
+
+		if !ok || strings.HasPrefix(link, "#") || wiki.isUnsupportedLink(link) {
+			return
+		}
+
+		page := wiki.pageTitleFromRelativeLink(link)
+
+		if !seen[page] {
+			seen[page] = true
+			pages = append(pages, page)
+		}
+	}
+
+	doc.Find(wiki.BodySelector + " a").Each(collector)
+	doc.Find(wiki.BodySelector + " area").Each(collector)
+
+	return pages
+}
+
+func (wiki *Wiki) rewriteWikiURLs(doc *goquery.Document, filter LinkFilter) (string, error) {
+	var forbidden map[string]bool
+
+	if filter != nil {
+		var err error
+
+		forbidden, err = filter(wiki, wiki.linkedPages(doc))
+
+		if err != nil {
+			return "", err
+		}
+	}
+
 	hrefRewriter := func(i int, e *goquery.Selection) {
 		link, ok := e.Attr("href")
 
@@ -246,6 +299,17 @@ func (wiki *Wiki) rewriteWikiURLs(doc *goquery.Document) (string, error) {
 			return
 		}
 
+		// Disable links to pages that are forbidden in this game.
+		if forbidden[wiki.pageTitleFromRelativeLink(link)] {
+			e.Nodes[0].Attr = append(e.Nodes[0].Attr, html.Attribute{
+				Key: "style",
+				Val: "color: gray; text-decoration: line-through;",
+			})
+			setAttributeValue(e.Nodes[0], "href", "#"+link)
+			setAttributeValue(e.Nodes[0], "onClick", "javascript: alert('This page is forbidden in this game.');")
+			return
+		}
+
 		page := wiki.pageNameFromRelativeLink(link)
 
 		setAttributeValue(e.Nodes[0], "href", Config.PageTranslator(page))
@@ -276,6 +340,18 @@ func (wiki *Wiki) pageNameFromRelativeLink(path string) string {
 	return path[len("/wiki/"):]
 }
 
+// Like pageNameFromRelativeLink but unescaped and normalized to the
+// displayed title.
+func (wiki *Wiki) pageTitleFromRelativeLink(path string) string {
+	name := wiki.pageNameFromRelativeLink(path)
+
+	if unescaped, err := url.QueryUnescape(name); err == nil {
+		name = unescaped
+	}
+
+	return NormalizeTitle(name)
+}
+
 // The different Wiki configurations are stored in a separate configuration
 // file so that the different aspects, such as the RandomPage, can be
 // confgured separately.
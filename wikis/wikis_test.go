@@ -1,6 +1,9 @@
 package wikis
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -20,3 +23,88 @@ func TestResolveCorrectTitle(t *testing.T) {
 		}
 	}
 }
+
+func TestSamePage(t *testing.T) {
+	cases := []struct {
+		A, B string
+		Same bool
+	}{
+		{"Kevin_Bacon", "Kevin Bacon", true},
+		{"Philosophy", "Philosophy", true},
+		{"Philosophy", "Philosopher", false},
+	}
+
+	for _, e := range cases {
+		if SamePage(e.A, e.B) != e.Same {
+			t.Errorf("SamePage(%q, %q) should be %t", e.A, e.B, e.Same)
+		}
+	}
+}
+
+func TestSeededStartAndGoal(t *testing.T) {
+	// Every prefix is an article, except for those starting with Z.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		from := r.URL.Query().Get("apfrom")
+
+		var result struct {
+			Query struct {
+				AllPages []struct{ Title string } `json:"allpages"`
+			} `json:"query"`
+		}
+
+		if len(from) == 0 {
+			from = "Aardvark"
+		}
+
+		if from[0] != 'Z' {
+			result.Query.AllPages = append(result.Query.AllPages, struct{ Title string }{from})
+		}
+
+		json.NewEncoder(w).Encode(result)
+	}))
+	defer server.Close()
+
+	wiki := &Wiki{URL: server.URL}
+
+	start, goal, err := wiki.SeededStartAndGoal(42)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if SamePage(start, goal) {
+		t.Errorf("Start and goal are both %q.", start)
+	}
+
+	for i := 0; i < 3; i++ {
+		if s, g, _ := wiki.SeededStartAndGoal(42); s != start || g != goal {
+			t.Errorf("Same seed chose %q and %q instead of %q and %q.", s, g, start, goal)
+		}
+	}
+
+	if s, g, _ := wiki.SeededStartAndGoal(43); s == start && g == goal {
+		t.Error("Another seed chose the same start and goal.")
+	}
+}
+
+func TestPageCategoriesHidden(t *testing.T) {
+	var clshow []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clshow = append(clshow, r.URL.Query().Get("clshow"))
+		w.Write([]byte(`{"query":{"pages":{}}}`))
+	}))
+	defer server.Close()
+
+	wiki := &Wiki{URL: server.URL}
+
+	for _, hidden := range []bool{true, false} {
+		if _, err := wiki.PageCategories([]string{"Philosophy"}, hidden); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if clshow[0] != "" || clshow[1] != "!hidden" {
+		t.Errorf("Expected hidden categories only to be left out on request, got %q.", clshow)
+	}
+}